@@ -0,0 +1,147 @@
+package postgres
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/DroiTaipei/droictx"
+	de "github.com/DroiTaipei/droipkg"
+	"github.com/DroiTaipei/droipkg/rdb"
+)
+
+const (
+	// EWMA_ALPHA is the weight of the newest latency sample
+	EWMA_ALPHA = 0.2
+	// LATENCY_EXPLORE_RATE sends 1 of every N calls round robin in LATENCY_MODE,
+	// so a session left for being slow gets new samples
+	LATENCY_EXPLORE_RATE = 20
+)
+
+// logSQL logs as sqlLog, and samples the spent time for LATENCY_MODE
+func (s *Session) logSQL(ctx droictx.Context, sql string, start time.Time) {
+	s.observeLatency(sqlLog(ctx, s.DBInfo.Name, sql, start))
+}
+
+func (s *Session) observeLatency(ms int64) {
+	for {
+		old := atomic.LoadUint64(&s.ewmaBits)
+		v := float64(ms)
+		if old != 0 {
+			v = EWMA_ALPHA*v + (1-EWMA_ALPHA)*math.Float64frombits(old)
+		}
+		if atomic.CompareAndSwapUint64(&s.ewmaBits, old, math.Float64bits(v)) {
+			return
+		}
+	}
+}
+
+// Latency is the EWMA of the query latency in milliseconds, 0 before any sample
+func (s *Session) Latency() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.ewmaBits))
+}
+
+// InFlight is the number of the pool calls running on the session
+func (s *Session) InFlight() int64 {
+	return atomic.LoadInt64(&s.inflight)
+}
+
+// leastConnEndPoint starts the scan at a rotating position, so ties are spread.
+// The caller holds sp.mu.
+func (sp *SessionPool) leastConnEndPoint() (*Session, de.AsDroiError) {
+	l := len(sp.validEpList)
+	if l == 0 {
+		return nil, de.NewTraceWithMsg(rdb.ErrDatabaseUnavailable, "")
+	}
+	start := int(atomic.AddUint64(&sp.pos, 1) % uint64(l))
+	best := sp.validEpList[start]
+	for i := 1; i < l; i++ {
+		s := sp.validEpList[(start+i)%l]
+		if s.InFlight() < best.InFlight() {
+			best = s
+		}
+	}
+	return best, nil
+}
+
+// latencyEndPoint scores the sessions by latency times the in-flight calls plus one,
+// the caller holds sp.mu
+func (sp *SessionPool) latencyEndPoint() (*Session, de.AsDroiError) {
+	l := len(sp.validEpList)
+	if l == 0 {
+		return nil, de.NewTraceWithMsg(rdb.ErrDatabaseUnavailable, "")
+	}
+	p := atomic.AddUint64(&sp.pos, 1)
+	if p%LATENCY_EXPLORE_RATE == 0 {
+		return sp.validEpList[(p/LATENCY_EXPLORE_RATE)%uint64(l)], nil
+	}
+	var best *Session
+	bestScore := 0.0
+	for i := 0; i < l; i++ {
+		s := sp.validEpList[i]
+		score := s.Latency() * float64(s.InFlight()+1)
+		if best == nil || score < bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best, nil
+}
+
+// weight is the runtime weight of the session, at least 1
+func (s *Session) weight() int64 {
+	if w := atomic.LoadInt64(&s.curWeight); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// SetWeight adjusts the weight of the session of name at runtime
+func (sp *SessionPool) SetWeight(name string, weight int) error {
+	if weight < 0 {
+		return de.NewError("Set Weight Failed: Negative Weight")
+	}
+	ss := sp.endPoints()
+	b := len(ss)
+	for i := 0; i < b; i++ {
+		if ss[i].Name == name {
+			atomic.StoreInt64(&ss[i].curWeight, int64(weight))
+			sp.CheckValidList()
+			return nil
+		}
+	}
+	return de.NewError("Set Weight Failed: " + name + " Not Found")
+}
+
+// checkWeighted tells whether the valid sessions have different weights,
+// the caller holds sp.mu for writing
+func (sp *SessionPool) checkWeighted() {
+	sp.weighted = false
+	b := len(sp.validEpList)
+	for i := 1; i < b; i++ {
+		if sp.validEpList[i].weight() != sp.validEpList[0].weight() {
+			sp.weighted = true
+			return
+		}
+	}
+}
+
+// swrrEndPoint is the smooth weighted round robin of nginx,
+// the caller holds sp.mu, and validEpList is not empty
+func (sp *SessionPool) swrrEndPoint() *Session {
+	sp.wmu.Lock()
+	defer sp.wmu.Unlock()
+	var best *Session
+	total := int64(0)
+	b := len(sp.validEpList)
+	for i := 0; i < b; i++ {
+		s := sp.validEpList[i]
+		w := s.weight()
+		s.swrrCurrent += w
+		total += w
+		if best == nil || s.swrrCurrent > best.swrrCurrent {
+			best = s
+		}
+	}
+	best.swrrCurrent -= total
+	return best
+}
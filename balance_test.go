@@ -0,0 +1,140 @@
+package postgres
+
+import (
+	"strings"
+	"testing"
+)
+
+func weightedPool(t *testing.T, weights map[string]int) *SessionPool {
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	for _, name := range []string{"a", "b", "c"} {
+		sp.AddEndPoint(workableSession(name, ""))
+	}
+	for name, w := range weights {
+		if err := sp.SetWeight(name, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sp
+}
+
+func TestSWRRDistribution(t *testing.T) {
+	sp := weightedPool(t, map[string]int{"a": 5, "b": 1, "c": 1})
+	if !sp.weighted {
+		t.Fatal("the pool of different weights is not weighted")
+	}
+
+	// One round of nginx smooth weighted round robin for 5, 1, 1
+	var seq []string
+	for i := 0; i < 7; i++ {
+		s, err := sp.RREndPoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq = append(seq, s.Name)
+	}
+	if got := strings.Join(seq, ""); got != "aabacaa" {
+		t.Errorf("sequence %s, want aabacaa", got)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 700; i++ {
+		s, _ := sp.RREndPoint()
+		counts[s.Name]++
+	}
+	if counts["a"] != 500 || counts["b"] != 100 || counts["c"] != 100 {
+		t.Errorf("700 picks %v, want a 500, b 100, c 100", counts)
+	}
+}
+
+func TestSWRRZeroWeightIsOne(t *testing.T) {
+	// 0 is taken as 1, then all weights are equal and plain round robin serves
+	sp := weightedPool(t, map[string]int{"a": 0})
+	if sp.weighted {
+		t.Error("weights 0, 1, 1 are taken as different")
+	}
+	if err := sp.SetWeight("a", -1); err == nil {
+		t.Error("a negative weight is accepted")
+	}
+	if err := sp.SetWeight("x", 1); err == nil {
+		t.Error("the weight of an unknown endpoint is accepted")
+	}
+}
+
+func TestLeastConnSpreadsTies(t *testing.T) {
+	sp := weightedPool(t, nil)
+	pick := func() string {
+		sp.mu.RLock()
+		defer sp.mu.RUnlock()
+		s, err := sp.leastConnEndPoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Name
+	}
+
+	// No call in flight, every session is a tie and gets its turn
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[pick()] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("3 picks of ties reach %v, want all of a, b and c", seen)
+	}
+
+	ss := sp.endPoints()
+	ss[0].acquire()
+	ss[1].acquire()
+	for i := 0; i < 5; i++ {
+		if got := pick(); got != "c" {
+			t.Fatalf("pick %d: %s, want c, the only idle one", i, got)
+		}
+	}
+}
+
+func TestObserveLatencyEWMA(t *testing.T) {
+	s := workableSession("a", "")
+	if s.Latency() != 0 {
+		t.Fatalf("latency before any sample %v, want 0", s.Latency())
+	}
+	s.observeLatency(100)
+	if s.Latency() != 100 {
+		t.Fatalf("the first sample gives %v, want 100", s.Latency())
+	}
+	s.observeLatency(200)
+	// 0.2*200 + 0.8*100
+	if got := s.Latency(); got < 119.999 || got > 120.001 {
+		t.Errorf("after 200 the latency is %v, want 120", got)
+	}
+}
+
+func TestLatencyEndPoint(t *testing.T) {
+	sp := weightedPool(t, nil)
+	ss := sp.endPoints()
+	ss[0].observeLatency(10)
+	ss[1].observeLatency(20)
+	ss[2].observeLatency(30)
+
+	counts := map[string]int{}
+	for i := 0; i < 2*LATENCY_EXPLORE_RATE; i++ {
+		sp.mu.RLock()
+		s, _ := sp.latencyEndPoint()
+		sp.mu.RUnlock()
+		counts[s.Name]++
+	}
+	// All but the exploring calls go to the fastest
+	if counts["a"] != 2*LATENCY_EXPLORE_RATE-2 {
+		t.Errorf("picks %v, want a %d", counts, 2*LATENCY_EXPLORE_RATE-2)
+	}
+
+	// 10ms with 3 calls in flight scores 40, worse than the idle 20ms
+	for i := 0; i < 3; i++ {
+		ss[0].acquire()
+	}
+	sp.mu.RLock()
+	s, _ := sp.latencyEndPoint()
+	sp.mu.RUnlock()
+	if s.Name != "b" {
+		t.Errorf("busy a: %s, want b", s.Name)
+	}
+}
@@ -0,0 +1,215 @@
+package postgres
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    = "CLOSED"
+	BREAKER_OPEN      = "OPEN"
+	BREAKER_HALF_OPEN = "HALF_OPEN"
+)
+
+// BreakerConfig controls the circuit breaker of a Session.
+// The breaker opens while the failure rate in Window reaches FailureRate,
+// stays open for OpenTimeout, then lets HalfOpenProbes calls through,
+// and closes after all of them succeed.
+type BreakerConfig struct {
+	// Window is the rolling window of the failure rate, 10s by default
+	Window time.Duration
+	// Buckets is how many slices the window rolls by, 10 by default
+	Buckets int
+	// MinRequests is the least calls in the window before the failure rate counts, 5 by default
+	MinRequests int
+	// FailureRate is between 0 and 1, 0.5 by default
+	FailureRate float64
+	// OpenTimeout is HCInterval by default, or 5s while HCInterval is 0
+	OpenTimeout time.Duration
+	// HalfOpenProbes is 1 by default
+	HalfOpenProbes int
+}
+
+func (c BreakerConfig) withDefaults(hcInterval time.Duration) BreakerConfig {
+	if c.Window <= 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.Buckets <= 0 {
+		c.Buckets = 10
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 5
+	}
+	if c.FailureRate <= 0 || c.FailureRate > 1 {
+		c.FailureRate = 0.5
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = hcInterval
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = 5 * time.Second
+	}
+	if c.HalfOpenProbes <= 0 {
+		c.HalfOpenProbes = 1
+	}
+	return c
+}
+
+type bucket struct {
+	epoch     int64
+	successes int
+	failures  int
+}
+
+type breaker struct {
+	mu  sync.Mutex
+	cfg BreakerConfig
+	// state is written under mu, and read without it by State
+	state   atomic.Value
+	buckets []bucket
+	// probes is how many calls half-open let through, successes is how many of them succeeded
+	probes     int
+	successes  int
+	halfOpenAt time.Time
+}
+
+func newBreaker(cfg BreakerConfig) *breaker {
+	b := &breaker{cfg: cfg, buckets: make([]bucket, cfg.Buckets)}
+	b.state.Store(BREAKER_CLOSED)
+	return b
+}
+
+// configure applies cfg, the window restarts while its size changed
+func (b *breaker) configure(cfg BreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cfg.Buckets != b.cfg.Buckets || cfg.Window != b.cfg.Window {
+		b.buckets = make([]bucket, cfg.Buckets)
+	}
+	b.cfg = cfg
+}
+
+func (b *breaker) State() string {
+	return b.state.Load().(string)
+}
+
+func (b *breaker) openTimeout() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cfg.OpenTimeout
+}
+
+// allow admits a call, half-open admits only HalfOpenProbes calls per OpenTimeout
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.State() {
+	case BREAKER_CLOSED:
+		return true
+	case BREAKER_HALF_OPEN:
+		// The probes which never reported give their slots back after OpenTimeout
+		if time.Since(b.halfOpenAt) > b.cfg.OpenTimeout {
+			b.halfOpenAt = time.Now()
+			b.probes = b.successes
+		}
+		if b.probes < b.cfg.HalfOpenProbes {
+			b.probes++
+			return true
+		}
+	}
+	return false
+}
+
+// success records a call which reached the server, it returns true while the state changed
+func (b *breaker) success() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.State() {
+	case BREAKER_CLOSED:
+		b.current().successes++
+	case BREAKER_HALF_OPEN:
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenProbes {
+			b.toLocked(BREAKER_CLOSED)
+			return true
+		}
+	}
+	return false
+}
+
+// failure records a call which could not reach the server, it returns true while the state changed
+func (b *breaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.State() {
+	case BREAKER_CLOSED:
+		b.current().failures++
+		successes, failures := b.counts()
+		total := successes + failures
+		if total >= b.cfg.MinRequests && float64(failures) >= b.cfg.FailureRate*float64(total) {
+			b.toLocked(BREAKER_OPEN)
+			return true
+		}
+	case BREAKER_HALF_OPEN:
+		b.toLocked(BREAKER_OPEN)
+		return true
+	}
+	return false
+}
+
+// to forces the state, it returns true while the state changed
+func (b *breaker) to(state string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.State() == state {
+		return false
+	}
+	b.toLocked(state)
+	return true
+}
+
+// halfOpen turns the open breaker half-open, it returns false while the breaker is not open
+func (b *breaker) halfOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.State() != BREAKER_OPEN {
+		return false
+	}
+	b.toLocked(BREAKER_HALF_OPEN)
+	return true
+}
+
+func (b *breaker) toLocked(state string) {
+	b.state.Store(state)
+	b.probes = 0
+	b.successes = 0
+	b.halfOpenAt = time.Now()
+	if state == BREAKER_CLOSED {
+		for i := range b.buckets {
+			b.buckets[i] = bucket{}
+		}
+	}
+}
+
+// current is the bucket of now, the caller holds b.mu
+func (b *breaker) current() *bucket {
+	epoch := time.Now().UnixNano() / int64(b.cfg.Window/time.Duration(b.cfg.Buckets))
+	bk := &b.buckets[epoch%int64(len(b.buckets))]
+	if bk.epoch != epoch {
+		*bk = bucket{epoch: epoch}
+	}
+	return bk
+}
+
+// counts sums the buckets in the window, the caller holds b.mu
+func (b *breaker) counts() (successes, failures int) {
+	epoch := time.Now().UnixNano() / int64(b.cfg.Window/time.Duration(b.cfg.Buckets))
+	for _, bk := range b.buckets {
+		if epoch-bk.epoch < int64(len(b.buckets)) {
+			successes += bk.successes
+			failures += bk.failures
+		}
+	}
+	return
+}
@@ -0,0 +1,123 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+)
+
+func testBreaker() *breaker {
+	return newBreaker(BreakerConfig{
+		Window:         200 * time.Millisecond,
+		Buckets:        4,
+		MinRequests:    4,
+		FailureRate:    0.5,
+		OpenTimeout:    30 * time.Millisecond,
+		HalfOpenProbes: 2,
+	}.withDefaults(0))
+}
+
+func TestBreakerTrips(t *testing.T) {
+	b := testBreaker()
+	for i := 0; i < 3; i++ {
+		if b.failure() {
+			t.Fatalf("failure %d of 3 opens, less than MinRequests", i+1)
+		}
+	}
+	if !b.failure() || b.State() != BREAKER_OPEN {
+		t.Fatal("the 4th failure does not open")
+	}
+
+	// 2 of 5 is under the rate, 3 of 6 reaches it
+	b = testBreaker()
+	for i := 0; i < 3; i++ {
+		b.success()
+	}
+	b.failure()
+	if b.failure() {
+		t.Fatal("2 failures of 5 calls open")
+	}
+	if !b.failure() {
+		t.Fatal("3 failures of 6 calls do not open")
+	}
+	if b.allow() {
+		t.Error("the open breaker admits a call")
+	}
+}
+
+func TestBreakerCycle(t *testing.T) {
+	b := testBreaker()
+	if !b.to(BREAKER_OPEN) || b.to(BREAKER_OPEN) {
+		t.Fatal("to reports the change wrong")
+	}
+	if !b.halfOpen() || b.State() != BREAKER_HALF_OPEN {
+		t.Fatal("the open breaker does not turn half-open")
+	}
+	if b.halfOpen() {
+		t.Error("halfOpen changes a breaker which is not open")
+	}
+
+	// HalfOpenProbes calls pass, then it waits for them
+	if !b.allow() || !b.allow() {
+		t.Fatal("half-open does not admit its 2 probes")
+	}
+	if b.allow() {
+		t.Fatal("half-open admits a 3rd probe")
+	}
+	if b.success() {
+		t.Fatal("1 of 2 probes closes")
+	}
+	if !b.success() || b.State() != BREAKER_CLOSED {
+		t.Fatal("2 succeeded probes do not close")
+	}
+	// Closing forgets the failures before
+	if b.failure() {
+		t.Error("a single failure after closing opens")
+	}
+
+	// A failed probe opens again
+	b.to(BREAKER_OPEN)
+	b.halfOpen()
+	b.allow()
+	if !b.failure() || b.State() != BREAKER_OPEN {
+		t.Error("a failed probe does not open")
+	}
+}
+
+func TestBreakerProbeSlots(t *testing.T) {
+	b := testBreaker()
+	b.to(BREAKER_OPEN)
+	b.halfOpen()
+	b.allow()
+	b.allow()
+	b.success()
+	if b.allow() {
+		t.Fatal("half-open admits a probe before OpenTimeout")
+	}
+
+	// The unreported probe gives its slot back, the succeeded one keeps it
+	time.Sleep(50 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("the slot of the unreported probe is not given back")
+	}
+	if b.allow() {
+		t.Error("the slot of the succeeded probe is given back")
+	}
+}
+
+func TestBreakerRollingWindow(t *testing.T) {
+	b := testBreaker()
+	for i := 0; i < 3; i++ {
+		b.failure()
+	}
+	// The failures leave the window, so the next one is the only call counted
+	time.Sleep(300 * time.Millisecond)
+	if b.failure() {
+		t.Error("failures out of the window open")
+	}
+	b.mu.Lock()
+	s, f := b.counts()
+	b.mu.Unlock()
+	if s != 0 || f != 1 {
+		t.Errorf("window has %d successes and %d failures, want 0 and 1", s, f)
+	}
+}
@@ -0,0 +1,171 @@
+package postgres
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/DroiTaipei/droictx"
+	de "github.com/DroiTaipei/droipkg"
+	"github.com/DroiTaipei/droipkg/rdb"
+)
+
+// querier runs the SQL of SelectBuilder, it is Session, SessionPool or Tx
+type querier interface {
+	SQLQuery(ctx droictx.Context, ret interface{}, querySql string, args ...interface{}) de.AsDroiError
+}
+
+// SelectBuilder builds a SELECT statement by the chained calls, such as
+//
+//	Select(ctx, "u.id", "count(o.id) AS orders").From("users u").
+//		Join("LEFT JOIN orders o ON o.user_id = u.id").
+//		Where("u.created_at > ?", since).GroupBy("u.id").
+//		OrderBy("orders DESC").Limit(10).Into(&ret)
+//
+// The conditions take ? as the placeholder. Where and Having are joined by AND.
+type SelectBuilder struct {
+	ctx     droictx.Context
+	q       querier
+	fields  []string
+	from    string
+	joins   []string
+	where   []string
+	groupBy []string
+	having  []string
+	orderBy []string
+	limit   int
+	offset  int
+	// joinArgs, whereArgs and havingArgs are kept apart, since the args follow the clause order
+	joinArgs   []interface{}
+	whereArgs  []interface{}
+	havingArgs []interface{}
+	err        de.AsDroiError
+}
+
+func newSelect(ctx droictx.Context, q querier, fields []string) *SelectBuilder {
+	return &SelectBuilder{ctx: ctx, q: q, fields: fields, limit: -1, offset: -1}
+}
+
+// Select starts a SelectBuilder on the session, fields are * while they are empty
+func (s *Session) Select(ctx droictx.Context, fields ...string) *SelectBuilder {
+	return newSelect(ctx, s, fields)
+}
+
+// Select starts a SelectBuilder on the pool, which runs as SQLQuery
+func (sp *SessionPool) Select(ctx droictx.Context, fields ...string) *SelectBuilder {
+	return newSelect(ctx, sp, fields)
+}
+
+// Select starts a SelectBuilder in the transaction
+func (t *Tx) Select(ctx droictx.Context, fields ...string) *SelectBuilder {
+	return newSelect(ctx, t, fields)
+}
+
+func (b *SelectBuilder) From(table string) *SelectBuilder {
+	b.from = table
+	return b
+}
+
+// Join takes a whole join clause, such as "LEFT JOIN orders o ON o.user_id = u.id"
+func (b *SelectBuilder) Join(join string, args ...interface{}) *SelectBuilder {
+	b.joins = append(b.joins, join)
+	b.joinArgs = append(b.joinArgs, args...)
+	return b
+}
+
+func (b *SelectBuilder) Where(cond string, args ...interface{}) *SelectBuilder {
+	if err := checkWhere(cond, args); err != nil && b.err == nil {
+		b.err = err
+	}
+	b.where = append(b.where, cond)
+	b.whereArgs = append(b.whereArgs, args...)
+	return b
+}
+
+func (b *SelectBuilder) GroupBy(fields ...string) *SelectBuilder {
+	b.groupBy = append(b.groupBy, fields...)
+	return b
+}
+
+func (b *SelectBuilder) Having(cond string, args ...interface{}) *SelectBuilder {
+	if err := checkWhere(cond, args); err != nil && b.err == nil {
+		b.err = err
+	}
+	b.having = append(b.having, cond)
+	b.havingArgs = append(b.havingArgs, args...)
+	return b
+}
+
+func (b *SelectBuilder) OrderBy(orders ...string) *SelectBuilder {
+	b.orderBy = append(b.orderBy, orders...)
+	return b
+}
+
+func (b *SelectBuilder) Limit(limit int) *SelectBuilder {
+	b.limit = limit
+	return b
+}
+
+func (b *SelectBuilder) Offset(offset int) *SelectBuilder {
+	b.offset = offset
+	return b
+}
+
+// ToSQL renders the statement with ? placeholders, and its args in order
+func (b *SelectBuilder) ToSQL() (string, []interface{}) {
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	if len(b.fields) == 0 {
+		sb.WriteString("*")
+	} else {
+		sb.WriteString(strings.Join(b.fields, ", "))
+	}
+	if len(b.from) > 0 {
+		sb.WriteString(" FROM " + b.from)
+	}
+	for _, join := range b.joins {
+		sb.WriteString(" " + join)
+	}
+	if len(b.where) > 0 {
+		sb.WriteString(" WHERE " + andConds(b.where))
+	}
+	if len(b.groupBy) > 0 {
+		sb.WriteString(" GROUP BY " + strings.Join(b.groupBy, ", "))
+	}
+	if len(b.having) > 0 {
+		sb.WriteString(" HAVING " + andConds(b.having))
+	}
+	if len(b.orderBy) > 0 {
+		sb.WriteString(" ORDER BY " + strings.Join(b.orderBy, ", "))
+	}
+	if b.limit >= 0 {
+		sb.WriteString(" LIMIT " + strconv.Itoa(b.limit))
+	}
+	if b.offset >= 0 {
+		sb.WriteString(" OFFSET " + strconv.Itoa(b.offset))
+	}
+	args := make([]interface{}, 0, len(b.joinArgs)+len(b.whereArgs)+len(b.havingArgs))
+	args = append(args, b.joinArgs...)
+	args = append(args, b.whereArgs...)
+	args = append(args, b.havingArgs...)
+	return sb.String(), args
+}
+
+// Into runs the statement, and scans the result into ret
+func (b *SelectBuilder) Into(ret interface{}) de.AsDroiError {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.from) == 0 {
+		return de.NewTraceWithMsg(rdb.ErrProcessFailed, "Select without From")
+	}
+	querySql, args := b.ToSQL()
+	return b.q.SQLQuery(b.ctx, ret, querySql, args...)
+}
+
+// andConds joins the conditions by AND, each one in parentheses for its own OR
+func andConds(conds []string) string {
+	if len(conds) == 1 {
+		return conds[0]
+	}
+	return "(" + strings.Join(conds, ") AND (") + ")"
+}
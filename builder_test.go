@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"reflect"
+	"testing"
+)
+
+func wantSQL(t *testing.T, b *SelectBuilder, sql string, args ...interface{}) {
+	t.Helper()
+	got, gotArgs := b.ToSQL()
+	if got != sql {
+		t.Errorf("got %q, want %q", got, sql)
+	}
+	if args == nil {
+		args = []interface{}{}
+	}
+	if !reflect.DeepEqual(gotArgs, args) {
+		t.Errorf("got args %v, want %v", gotArgs, args)
+	}
+}
+
+func TestSelectBuilderWhere(t *testing.T) {
+	wantSQL(t, newSelect(nil, nil, nil).From("users"), "SELECT * FROM users")
+	wantSQL(t, newSelect(nil, nil, nil).From("users").Where("id = ?", 1), "SELECT * FROM users WHERE id = ?", 1)
+	// Each Where is parenthesized, so an OR inside does not leak into the AND
+	wantSQL(t, newSelect(nil, nil, nil).From("users").Where("a = ? OR b = ?", 1, 2).Where("c = ?", 3),
+		"SELECT * FROM users WHERE (a = ? OR b = ?) AND (c = ?)", 1, 2, 3)
+}
+
+// TestSelectBuilderClauseOrder calls the clauses backwards,
+// the SQL and its args come out in the order of the statement anyway
+func TestSelectBuilderClauseOrder(t *testing.T) {
+	b := newSelect(nil, nil, nil).From("users u").
+		Having("count(*) > ?", 5).
+		Where("u.age > ?", 18).
+		Join("LEFT JOIN orders o ON o.user_id = u.id AND o.state = ?", "paid").
+		GroupBy("u.id").
+		OrderBy("u.id DESC")
+	wantSQL(t, b, "SELECT * FROM users u LEFT JOIN orders o ON o.user_id = u.id AND o.state = ? "+
+		"WHERE u.age > ? GROUP BY u.id HAVING count(*) > ? ORDER BY u.id DESC", "paid", 18, 5)
+}
+
+func TestSelectBuilderPaging(t *testing.T) {
+	wantSQL(t, newSelect(nil, nil, nil).From("users").Limit(10).Offset(20), "SELECT * FROM users LIMIT 10 OFFSET 20")
+	// An explicit 0 is kept, unlike an unset limit
+	wantSQL(t, newSelect(nil, nil, nil).From("users").Limit(0), "SELECT * FROM users LIMIT 0")
+}
+
+func TestSelectBuilderFields(t *testing.T) {
+	wantSQL(t, newSelect(nil, nil, []string{"id", "name"}).From("users"), "SELECT id, name FROM users")
+}
+
+func TestSelectBuilderIntoErrors(t *testing.T) {
+	if err := newSelect(nil, nil, nil).Into(nil); err == nil {
+		t.Error("Into runs without From")
+	}
+	SetStrictWhere(true)
+	defer SetStrictWhere(false)
+	err := newSelect(nil, nil, nil).From("users").Where("name = 'bob'").Into(nil)
+	if err == nil || err.AsDroiError().ErrorCode() != ErrUnsafeWhere.ErrorCode() {
+		t.Errorf("got %v, want ErrUnsafeWhere", err)
+	}
+}
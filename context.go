@@ -0,0 +1,193 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DroiTaipei/droictx"
+	"github.com/devopstaku/gorm"
+)
+
+// stdCtx carries a context.Context and a statement timeout along with a droictx.Context
+type stdCtx struct {
+	droictx.Context
+	std     context.Context
+	timeout time.Duration
+	// conns are the gorm handles bound to std, built once per connection pool of a session
+	mu    sync.Mutex
+	conns map[*sql.DB]*gorm.DB
+}
+
+// WithContext binds c to ctx.
+// While c is done, the running queries of ctx are cancelled on the server,
+// and return ErrQueryCanceled.
+func WithContext(ctx droictx.Context, c context.Context) droictx.Context {
+	if sc, ok := ctx.(*stdCtx); ok {
+		return &stdCtx{Context: sc.Context, std: c, timeout: sc.timeout}
+	}
+	return &stdCtx{Context: ctx, std: c}
+}
+
+// WithTimeout is WithContext with a deadline of d from now
+func WithTimeout(ctx droictx.Context, d time.Duration) (droictx.Context, context.CancelFunc) {
+	parent := stdContext(ctx)
+	if parent == nil {
+		parent = context.Background()
+	}
+	c, cancel := context.WithTimeout(parent, d)
+	return WithContext(ctx, c), cancel
+}
+
+// WithStatementTimeout overrides DBInfo.StatementTimeout for the statements of ctx.
+// The statements exceeding d return ErrStatementTimeout.
+func WithStatementTimeout(ctx droictx.Context, d time.Duration) droictx.Context {
+	if sc, ok := ctx.(*stdCtx); ok {
+		return &stdCtx{Context: sc.Context, std: sc.std, timeout: d}
+	}
+	return &stdCtx{Context: ctx, timeout: d}
+}
+
+// stdContext is the context.Context bound to ctx, nil if there is none
+func stdContext(ctx droictx.Context) context.Context {
+	if sc, ok := ctx.(*stdCtx); ok {
+		return sc.std
+	}
+	return nil
+}
+
+// statementTimeout is the statement timeout override of ctx, 0 if there is none
+func statementTimeout(ctx droictx.Context) time.Duration {
+	if sc, ok := ctx.(*stdCtx); ok {
+		return sc.timeout
+	}
+	return 0
+}
+
+func millis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// sqlConn is satisfied by both *sql.DB and *sql.Conn
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// ctxDB runs the statements of gorm with a context,
+// lib/pq sends a cancel request to the server while the context is done.
+type ctxDB struct {
+	db  sqlConn
+	ctx context.Context
+}
+
+func (c *ctxDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c *ctxDB) Prepare(query string) (*sql.Stmt, error) {
+	return c.db.PrepareContext(c.ctx, query)
+}
+
+func (c *ctxDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c *ctxDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
+
+func (c *ctxDB) Begin() (*sql.Tx, error) {
+	return c.db.BeginTx(c.ctx, nil)
+}
+
+// BeginTx is called by gorm.DB.Begin and gorm.DB.BeginTx,
+// the bound context is kept while gorm passes one that is never done, such as context.Background
+func (c *ctxDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	if ctx.Done() == nil {
+		ctx = c.ctx
+	}
+	return c.db.BeginTx(ctx, opts)
+}
+
+// wrap opens a gorm handle on db with the settings of the session
+func (s *Session) wrap(db gorm.SQLCommon) (*gorm.DB, error) {
+	c, err := gorm.Open("postgres", db)
+	if err != nil {
+		return nil, err
+	}
+	c.LogMode(atomic.LoadInt32(&s.logMode) == 1)
+	return c, nil
+}
+
+// setLogMode applies enable to Conn and to the handles wrapped later
+func (s *Session) setLogMode(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&s.logMode, v)
+	s.conn().LogMode(enable)
+}
+
+// ctxConn is the connection bound to the context.Context of ctx,
+// the handle is kept in ctx for the following calls on the same session
+func (s *Session) ctxConn(ctx droictx.Context) *gorm.DB {
+	conn := s.conn()
+	sc, ok := ctx.(*stdCtx)
+	if !ok || sc.std == nil {
+		return conn
+	}
+	raw := conn.DB()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if db, ok := sc.conns[raw]; ok {
+		return db
+	}
+	db, err := s.wrap(&ctxDB{db: raw, ctx: sc.std})
+	if err != nil {
+		return conn
+	}
+	if sc.conns == nil {
+		sc.conns = map[*sql.DB]*gorm.DB{}
+	}
+	sc.conns[raw] = db
+	return db
+}
+
+// db is the connection for the statements of ctx, done must be called after the statements.
+// With a statement timeout override, it holds a dedicated connection
+// until done resets the timeout and returns it to the pool.
+func (s *Session) db(ctx droictx.Context) (db *gorm.DB, done func()) {
+	d := statementTimeout(ctx)
+	if d <= 0 {
+		return s.ctxConn(ctx), func() {}
+	}
+	c := stdContext(ctx)
+	if c == nil {
+		c = context.Background()
+	}
+	conn, err := s.conn().DB().Conn(c)
+	if err != nil {
+		return s.ctxConn(ctx), func() {}
+	}
+	done = func() {
+		conn.ExecContext(context.Background(), "RESET statement_timeout")
+		conn.Close()
+	}
+	_, err = conn.ExecContext(c, fmt.Sprintf("SET statement_timeout = %d", millis(d)))
+	if err == nil {
+		db, err = s.wrap(&ctxDB{db: conn, ctx: c})
+	}
+	if err != nil {
+		conn.Close()
+		return s.ctxConn(ctx), func() {}
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DroiTaipei/droictx"
+	"github.com/devopstaku/gorm"
+)
+
+// testCtx keeps the fields of a droictx.Context in a map
+type testCtx struct {
+	droictx.Context
+	fields map[string]interface{}
+}
+
+func newTestCtx() *testCtx {
+	return &testCtx{fields: map[string]interface{}{}}
+}
+
+func (c *testCtx) Set(key string, value interface{}) { c.fields[key] = value }
+func (c *testCtx) Get(key string) interface{}        { return c.fields[key] }
+func (c *testCtx) Map() map[string]interface{}       { return c.fields }
+
+// unreachableSession is a Session on a server which never answers, enough to build handles
+func unreachableSession(t *testing.T) *Session {
+	raw, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { raw.Close() })
+	// Open pings and fails, the handle is usable anyway
+	conn, _ := gorm.Open("postgres", raw)
+	if conn == nil {
+		t.Fatal("gorm.Open returns no handle")
+	}
+	return &Session{Conn: conn}
+}
+
+func TestCtxConnReusesHandle(t *testing.T) {
+	s := unreachableSession(t)
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx := WithContext(nil, c)
+
+	s.setLogMode(true)
+	first := s.ctxConn(ctx)
+	if first == s.Conn {
+		t.Fatal("ctxConn is not bound to the context")
+	}
+	if second := s.ctxConn(ctx); second != first {
+		t.Error("ctxConn opens a new handle on every call")
+	}
+	if other := s.ctxConn(WithContext(nil, c)); other == first {
+		t.Error("ctxConn shares a handle across contexts")
+	}
+}
+
+func TestCtxConnBegin(t *testing.T) {
+	var _ interface {
+		Begin() (*sql.Tx, error)
+		BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	} = &ctxDB{}
+
+	s := unreachableSession(t)
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx := s.ctxConn(WithContext(nil, c)).Begin()
+	if tx.Error == gorm.ErrCantStartTransaction {
+		t.Fatal("Begin is not supported under a bound context")
+	}
+	if tx.Error == nil {
+		tx.Rollback()
+	}
+}
@@ -1,16 +1,28 @@
 package postgres
 
 import (
-	"net"
-	"github.com/DroiTaipei/droipkg/rdb"
+	"context"
+	"database/sql/driver"
 	de "github.com/DroiTaipei/droipkg"
+	"github.com/DroiTaipei/droipkg/rdb"
 	"github.com/devopstaku/gorm"
 	"github.com/lib/pq"
+	"io"
+	"net"
+	"strings"
 )
 
-
 var (
-	errorCodeMap         map[pq.ErrorCode]de.DroiError
+	errorCodeMap map[pq.ErrorCode]de.DroiError
+	// Errors not covered by rdb
+	ErrSerializationFailure = de.NewCodeError(1090001, "Serialization Failure")
+	ErrDeadlockDetected     = de.NewCodeError(1090002, "Deadlock Detected")
+	ErrQueryCanceled        = de.NewCodeError(1090003, "Query Canceled")
+	ErrStatementTimeout     = de.NewCodeError(1090004, "Statement Timeout")
+	ErrUnsafeWhere          = de.NewCodeError(1090005, "Unsafe Where Clause")
+	ErrInvalidCursor        = de.NewCodeError(1090006, "Invalid Cursor")
+	ErrTxOptionsConflict    = de.NewCodeError(1090007, "Transaction Options Conflict")
+	ErrPoolNotFound         = de.NewCodeError(1090008, "Pool Not Found")
 )
 
 func init() {
@@ -21,34 +33,55 @@ func init() {
 		"42601": rdb.ErrProcessFailed,
 		"42703": rdb.ErrResourceNotFound,
 		"42704": rdb.ErrResourceNotFound,
+		"40001": ErrSerializationFailure,
+		"40P01": ErrDeadlockDetected,
+		"57014": ErrStatementTimeout,
 	}
 }
 
-func (s *Session) CheckDatabaseError(err error) (ret de.AsDroiError){
+func (s *Session) CheckDatabaseError(err error) (ret de.AsDroiError) {
 	var dErr de.DroiError
-	
+
 	if err != nil {
+		// reached tells whether the server answered, for the breaker
+		reached := true
 		dErr = rdb.ErrDatabase
 		switch err {
 		case gorm.ErrRecordNotFound:
 			dErr = rdb.ErrDataNotFound
 		case gorm.ErrInvalidSQL:
 			dErr = rdb.ErrProcessFailed
+		case context.Canceled, context.DeadlineExceeded:
+			dErr = ErrQueryCanceled
+			reached = false
+		case io.EOF, io.ErrUnexpectedEOF, driver.ErrBadConn:
+			// The connection was lost before the server answered
+			dErr = rdb.ErrDatabaseUnavailable
+			reached = false
+			s.recordFailure(err)
 		default:
 			switch e := err.(type) {
 			case *pq.Error:
 				m, handled := errorCodeMap[e.Code]
-				if handled {
+				// 57014 is also raised by the cancel request of a done context
+				if e.Code == "57014" && strings.Contains(e.Message, "user request") {
+					dErr = ErrQueryCanceled
+				} else if handled {
 					dErr = m
 				} else {
 					debug("Unhandle:", e.Code)
 				}
 			case net.Error:
 				dErr = rdb.ErrDatabaseUnavailable
-				s.unWorkable()
+				reached = false
+				s.recordFailure(err)
 			}
 		}
-		return de.NewTraceDroiError(dErr, err) 
+		if reached {
+			s.recordSuccess()
+		}
+		return de.NewTraceDroiError(dErr, err)
 	}
+	s.recordSuccess()
 	return nil
 }
@@ -0,0 +1,51 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DroiTaipei/droipkg/rdb"
+	"github.com/devopstaku/gorm"
+	"github.com/lib/pq"
+)
+
+func checkedSession() *Session {
+	return &Session{breaker: newBreaker(BreakerConfig{}.withDefaults(0))}
+}
+
+// TestCheckDatabaseErrorAnswered maps the errors the server answered, the session is not to blame for them
+func TestCheckDatabaseErrorAnswered(t *testing.T) {
+	s := checkedSession()
+	if err := s.CheckDatabaseError(gorm.ErrRecordNotFound); err.AsDroiError().ErrorCode() != rdb.ErrDataNotFound.ErrorCode() {
+		t.Errorf("no record: got %v, want rdb.ErrDataNotFound", err)
+	}
+	if err := s.CheckDatabaseError(&pq.Error{Code: "23505"}); err.AsDroiError().ErrorCode() != rdb.ErrPrimaryKeyDuplicated.ErrorCode() {
+		t.Errorf("unique_violation: got %v, want rdb.ErrPrimaryKeyDuplicated", err)
+	}
+	if err := s.CheckDatabaseError(context.Canceled); err.AsDroiError().ErrorCode() != ErrQueryCanceled.ErrorCode() {
+		t.Errorf("canceled: got %v, want ErrQueryCanceled", err)
+	}
+	if n := atomic.LoadInt64(&s.failures); n != 0 {
+		t.Errorf("%d failures counted, want 0", n)
+	}
+}
+
+// TestCheckDatabaseErrorLost checks a lost connection is unavailable and counts against the session
+func TestCheckDatabaseErrorLost(t *testing.T) {
+	lost := []error{io.EOF, io.ErrUnexpectedEOF, driver.ErrBadConn, &net.OpError{Op: "dial", Err: errors.New("refused")}}
+	for _, e := range lost {
+		s := checkedSession()
+		err := s.CheckDatabaseError(e)
+		if err == nil || err.AsDroiError().ErrorCode() != rdb.ErrDatabaseUnavailable.ErrorCode() {
+			t.Errorf("%v: got %v, want rdb.ErrDatabaseUnavailable", e, err)
+		}
+		if atomic.LoadInt64(&s.failures) != 1 {
+			t.Errorf("%v: not counted as a failure", e)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package postgres
+
+import "time"
+
+const (
+	EVENT_DOWN        = "DOWN"
+	EVENT_RECOVERED   = "RECOVERED"
+	EVENT_ADDED       = "ADDED"
+	EVENT_REMOVED     = "REMOVED"
+	EVENT_UNAVAILABLE = "UNAVAILABLE"
+)
+
+// EndpointEvent is passed to the OnEvent callbacks, Session is empty for EVENT_UNAVAILABLE
+type EndpointEvent struct {
+	Type    string
+	Session string
+	Cause   string
+	Time    time.Time
+}
+
+// OnEvent registers fn for the endpoint events of the pool.
+// fn runs in the goroutine which changed the endpoint, such as a call or the health checking,
+// so it should not block.
+func (sp *SessionPool) OnEvent(fn func(EndpointEvent)) {
+	sp.hookMu.Lock()
+	// A new slice, emit may be ranging over the former one
+	sp.hooks = append(sp.hooks[:len(sp.hooks):len(sp.hooks)], fn)
+	sp.hookMu.Unlock()
+}
+
+func (sp *SessionPool) emit(typ, session, cause string) {
+	sp.hookMu.RLock()
+	hooks := sp.hooks
+	sp.hookMu.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+	ev := EndpointEvent{Type: typ, Session: session, Cause: cause, Time: time.Now()}
+	b := len(hooks)
+	for i := 0; i < b; i++ {
+		hooks[i](ev)
+	}
+}
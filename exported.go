@@ -5,85 +5,142 @@ import (
 	"github.com/DroiTaipei/droictx"
 	de "github.com/DroiTaipei/droipkg"
 	"github.com/devopstaku/gorm"
+	"net/http"
 )
 
 func OneRecord(ctx droictx.Context, ret interface{}, whereClause string, args ...interface{}) (err de.AsDroiError) {
-	return stdPool.OneRecord(ctx, ret, whereClause, args...)
+	return std().OneRecord(ctx, ret, whereClause, args...)
 }
 
 func Query(ctx droictx.Context, where, order string, limit, offset int, ret interface{}) (err de.AsDroiError) {
-	return stdPool.Query(ctx, where, order, limit, offset, ret)
+	return std().Query(ctx, where, order, limit, offset, ret)
 }
 
 func TableQuery(ctx droictx.Context, table, where, order string, limit, offset int, ret interface{}) (err de.AsDroiError) {
-	return stdPool.TableQuery(ctx, table, where, order, limit, offset, ret)
+	return std().TableQuery(ctx, table, where, order, limit, offset, ret)
 }
 
 func SQLQuery(ctx droictx.Context, ret interface{}, querySql string, args ...interface{}) (err de.AsDroiError) {
-	return stdPool.SQLQuery(ctx, ret, querySql, args...)
+	return std().SQLQuery(ctx, ret, querySql, args...)
 }
 
 func WhereQuery(ctx droictx.Context, where interface{}, order string, limit, offset int, ret interface{}) (err de.AsDroiError) {
-	return stdPool.WhereQuery(ctx, where, order, limit, offset, ret)
+	return std().WhereQuery(ctx, where, order, limit, offset, ret)
 }
 
 func Count(ctx droictx.Context, where string, model interface{}, ret *int) (err de.AsDroiError) {
-	return stdPool.Count(ctx, where, model, ret)
+	return std().Count(ctx, where, model, ret)
+}
+
+func CriteriaQuery(ctx droictx.Context, ret interface{}, order string, limit, offset int, criteria string, args ...interface{}) (err de.AsDroiError) {
+	return std().CriteriaQuery(ctx, ret, order, limit, offset, criteria, args...)
+}
+
+func CriteriaTableQuery(ctx droictx.Context, ret interface{}, table, order string, limit, offset int, criteria string, args ...interface{}) (err de.AsDroiError) {
+	return std().CriteriaTableQuery(ctx, ret, table, order, limit, offset, criteria, args...)
+}
+
+func CriteriaCount(ctx droictx.Context, model interface{}, ret *int, criteria string, args ...interface{}) (err de.AsDroiError) {
+	return std().CriteriaCount(ctx, model, ret, criteria, args...)
 }
 
 func Insert(ctx droictx.Context, ret interface{}) (err de.AsDroiError) {
-	return stdPool.Insert(ctx, ret)
+	return std().Insert(ctx, ret)
 }
 
 func OmitInsert(ctx droictx.Context, ret interface{}, omit string) (err de.AsDroiError) {
-	return stdPool.OmitInsert(ctx, ret, omit)
+	return std().OmitInsert(ctx, ret, omit)
 }
 
 func Update(ctx droictx.Context, ret interface{}, fields map[string]interface{}) (err de.AsDroiError) {
-	return stdPool.Update(ctx, ret, fields)
+	return std().Update(ctx, ret, fields)
 }
 
 func UpdateNonBlank(ctx droictx.Context, ret interface{}) (err de.AsDroiError) {
-	return stdPool.UpdateNonBlank(ctx, ret)
+	return std().UpdateNonBlank(ctx, ret)
 }
 
 func CriteriaUpdate(ctx droictx.Context, ret interface{}, fields map[string]interface{}, criteria string, args ...interface{}) de.AsDroiError {
-	return stdPool.CriteriaUpdate(ctx, ret, fields, criteria, args ...)
+	return std().CriteriaUpdate(ctx, ret, fields, criteria, args...)
 }
 
 func Delete(ctx droictx.Context, ret interface{}) (err de.AsDroiError) {
-	return stdPool.Delete(ctx, ret)
+	return std().Delete(ctx, ret)
 }
 
-func CriteriaDelete(ctx droictx.Context, ret interface{}, criteria string, args ...interface{}) (err de.AsDroiError)  {
-	return stdPool.CriteriaDelete(ctx, ret, criteria, args ...)
+func CriteriaDelete(ctx droictx.Context, ret interface{}, criteria string, args ...interface{}) (err de.AsDroiError) {
+	return std().CriteriaDelete(ctx, ret, criteria, args...)
 }
 
-
-func Join(ctx droictx.Context, ret interface{}, table, fields, join, order, criteria string, args...interface{}) (err de.AsDroiError) {
-	return stdPool.Join(ctx, ret, table, fields, join, order, criteria, args...)
+func Join(ctx droictx.Context, ret interface{}, table, fields, join, order, criteria string, args ...interface{}) (err de.AsDroiError) {
+	return std().Join(ctx, ret, table, fields, join, order, criteria, args...)
 }
 
 func Execute(ctx droictx.Context, sql string, values ...interface{}) (err de.AsDroiError) {
-	return stdPool.Execute(ctx, sql, values...)
+	return std().Execute(ctx, sql, values...)
 }
 
-func Transaction(ctx droictx.Context, sqls []string) (err de.AsDroiError) {
-	return stdPool.Transaction(ctx, sqls)
+func Transaction(ctx droictx.Context, sqls []string, opts ...TxOptions) (err de.AsDroiError) {
+	return std().Transaction(ctx, sqls, opts...)
+}
+
+func WithTx(ctx droictx.Context, fn func(tx *Tx) error, opts ...TxOptions) (err de.AsDroiError) {
+	return std().WithTx(ctx, fn, opts...)
+}
+
+func WithTxRetry(ctx droictx.Context, policy TxRetryPolicy, fn func(tx *Tx) error, opts ...TxOptions) (err de.AsDroiError) {
+	return std().WithTxRetry(ctx, policy, fn, opts...)
 }
 
 func RowScan(ctx droictx.Context, sql string, ptrs ...interface{}) (err de.AsDroiError) {
-	return stdPool.RowScan(ctx, sql, ptrs...)
+	return std().RowScan(ctx, sql, ptrs...)
+}
+
+func RowScanArgs(ctx droictx.Context, sql string, args []interface{}, ptrs ...interface{}) (err de.AsDroiError) {
+	return std().RowScanArgs(ctx, sql, args, ptrs...)
 }
 
-func Rows(ctx droictx.Context, sql string) (rows *sql.Rows, err de.AsDroiError) {
-	return stdPool.Rows(ctx, sql)
+func Rows(ctx droictx.Context, sql string, args ...interface{}) (rows *sql.Rows, err de.AsDroiError) {
+	return std().Rows(ctx, sql, args...)
+}
+
+func EachRow(ctx droictx.Context, querySql string, fn func(*sql.Rows) error, args ...interface{}) (err de.AsDroiError) {
+	return std().EachRow(ctx, querySql, fn, args...)
 }
 
 func GetGORM(ctx droictx.Context) (ret *gorm.DB, err de.AsDroiError) {
-	return stdPool.GetGORM(ctx)
+	return std().GetGORM(ctx)
+}
+
+// Status is the health of the default pool, unavailable before Initialize
+func Status() PoolStatus {
+	sp := std()
+	if sp == nil {
+		return PoolStatus{EndPoints: []EndPointStatus{}}
+	}
+	return sp.Status()
+}
+
+// StatusHandler serves the Status of the default pool at the time of each request,
+// so it may be registered before Initialize and follows a re-initialize
+func StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, Status())
+	})
+}
+
+func KeysetQuery(ctx droictx.Context, ret interface{}, table string, keys []SortKey, cursor string, limit int, criteria string, args ...interface{}) (next string, err de.AsDroiError) {
+	return std().KeysetQuery(ctx, ret, table, keys, cursor, limit, criteria, args...)
+}
+
+func Select(ctx droictx.Context, fields ...string) *SelectBuilder {
+	return std().Select(ctx, fields...)
+}
+
+func OnEvent(fn func(EndpointEvent)) {
+	std().OnEvent(fn)
 }
 
 func LogMode(ctx droictx.Context, enable bool) (err de.AsDroiError) {
-	return stdPool.LogMode(ctx, enable)
+	return std().LogMode(ctx, enable)
 }
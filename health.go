@@ -0,0 +1,105 @@
+package postgres
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_HC_INTERVAL is the periodic health checking interval while HCInterval is 0
+const DEFAULT_HC_INTERVAL = 5 * time.Second
+
+// REPLICATION_LAG_SQL is the replay lag in seconds, 0 on a primary and on a replica which replayed all it received
+const REPLICATION_LAG_SQL = `SELECT CASE WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+// healthConfig is the health checking part of DBInfo, swapped as a whole by updateInfo
+type healthConfig struct {
+	query  string
+	maxLag time.Duration
+	// interval is the periodic checking of the workable session, 0 means none
+	interval time.Duration
+}
+
+func (s *Session) setHealth(info *DBInfo) {
+	hc := &healthConfig{query: info.HealthQuery, maxLag: info.MaxReplicationLag}
+	if hc.maxLag > 0 || len(hc.query) > 0 {
+		hc.interval = info.HCInterval
+		if hc.interval <= 0 {
+			hc.interval = DEFAULT_HC_INTERVAL
+		}
+	}
+	if hc.maxLag <= 0 && atomic.SwapInt32(&s.lagging, 0) == 1 {
+		// No limit any more, the caller rebuilds the valid list
+		atomic.StoreInt64(&s.lagNanos, 0)
+	}
+	s.health.Store(hc)
+}
+
+func (s *Session) healthConfig() *healthConfig {
+	return s.health.Load().(*healthConfig)
+}
+
+// testConnection runs HealthQuery, or Ping while it is empty,
+// then checks the replication lag while MaxReplicationLag is set.
+// It fails while the session never connected.
+func (s *Session) testConnection() bool {
+	hc := s.healthConfig()
+	c := s.conn()
+	if c == nil {
+		return false
+	}
+	db := c.DB()
+	var err error
+	if len(hc.query) > 0 {
+		_, err = db.Exec(hc.query)
+	} else {
+		err = db.Ping()
+	}
+	s.checked(err)
+	if err != nil {
+		debug(s.Name, " Health Checking Failed: ", err.Error())
+		return false
+	}
+	if hc.maxLag > 0 {
+		s.checkLag(hc.maxLag)
+	}
+	return true
+}
+
+// checkLag measures the replication lag, and rebuilds the valid list of the pool
+// while the session starts or stops lagging. A failed measuring keeps the former state.
+func (s *Session) checkLag(maxLag time.Duration) {
+	var seconds float64
+	c := s.conn()
+	if c == nil {
+		return
+	}
+	if err := c.DB().QueryRow(REPLICATION_LAG_SQL).Scan(&seconds); err != nil {
+		debug(s.Name, " Replication Lag Checking Failed: ", err.Error())
+		return
+	}
+	lag := time.Duration(seconds * float64(time.Second))
+	atomic.StoreInt64(&s.lagNanos, int64(lag))
+	var lagging int32
+	if lag > maxLag {
+		lagging = 1
+	}
+	if atomic.SwapInt32(&s.lagging, lagging) != lagging {
+		debug(s.Name, " Replication Lag ", lag.String(), ", Lagging: ", lagging == 1)
+		if lagging == 1 {
+			s.eventToPool(EVENT_DOWN, "replication lag "+lag.String()+" over "+maxLag.String())
+		} else {
+			s.eventToPool(EVENT_RECOVERED, "replication lag "+lag.String())
+		}
+	}
+}
+
+// ReplicationLag is the last measured replication lag, 0 without MaxReplicationLag
+func (s *Session) ReplicationLag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.lagNanos))
+}
+
+// Lagging tells whether the replication lag is over MaxReplicationLag
+func (s *Session) Lagging() bool {
+	return atomic.LoadInt32(&s.lagging) == 1
+}
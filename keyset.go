@@ -0,0 +1,166 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/DroiTaipei/droictx"
+	de "github.com/DroiTaipei/droipkg"
+	"github.com/DroiTaipei/droipkg/rdb"
+	"github.com/devopstaku/gorm"
+)
+
+// identifierRe is a plain or table qualified identifier, the only names KeysetQuery puts into SQL
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// SortKey is a column of the keyset order.
+// The columns should be NOT NULL, and the last one unique, such as the primary key.
+type SortKey struct {
+	Column string
+	Desc   bool
+}
+
+// keysetQuery is KeysetQuery on q, db is for the field lookup of the last row
+func keysetQuery(ctx droictx.Context, q querier, db *gorm.DB, ret interface{}, table string, keys []SortKey, cursor string, limit int, criteria string, args ...interface{}) (string, de.AsDroiError) {
+	if limit <= 0 || len(keys) == 0 {
+		return "", de.NewTraceWithMsg(rdb.ErrProcessFailed, "KeysetQuery needs a positive limit and sort keys")
+	}
+	if !identifierRe.MatchString(table) {
+		return "", de.NewTraceWithMsg(rdb.ErrProcessFailed, "Invalid Table "+table)
+	}
+	orders := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if !identifierRe.MatchString(k.Column) {
+			return "", de.NewTraceWithMsg(rdb.ErrProcessFailed, "Invalid Sort Column "+k.Column)
+		}
+		if k.Desc {
+			orders = append(orders, k.Column+" DESC")
+		} else {
+			orders = append(orders, k.Column+" ASC")
+		}
+	}
+
+	b := newSelect(ctx, q, nil).From(table).OrderBy(orders...).Limit(limit)
+	if len(criteria) > 0 {
+		b.Where(criteria, args...)
+	}
+	if len(cursor) > 0 {
+		values, err := decodeCursor(cursor, len(keys))
+		if err != nil {
+			return "", err
+		}
+		cond, condArgs := keysetCond(keys, values)
+		b.Where(cond, condArgs...)
+	}
+	if err := b.Into(ret); err != nil {
+		return "", err
+	}
+	return nextCursor(db, ret, keys, limit)
+}
+
+// keysetCond is the rows after values in the order of keys, as
+// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ..., with < for the descending keys
+func keysetCond(keys []SortKey, values []interface{}) (string, []interface{}) {
+	ors := make([]string, 0, len(keys))
+	var args []interface{}
+	for i, k := range keys {
+		ands := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			ands = append(ands, keys[j].Column+" = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if k.Desc {
+			op = " < ?"
+		}
+		ands = append(ands, k.Column+op)
+		args = append(args, values[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	return strings.Join(ors, " OR "), args
+}
+
+// nextCursor is the cursor of the last row in ret, empty while ret is not a full page
+func nextCursor(db *gorm.DB, ret interface{}, keys []SortKey, limit int) (string, de.AsDroiError) {
+	v := reflect.ValueOf(ret)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return "", de.NewTraceWithMsg(rdb.ErrProcessFailed, "KeysetQuery needs a pointer to slice")
+	}
+	v = v.Elem()
+	if v.Len() < limit {
+		return "", nil
+	}
+	last := v.Index(v.Len() - 1)
+	if last.Kind() != reflect.Ptr {
+		last = last.Addr()
+	}
+	scope := db.NewScope(last.Interface())
+	values := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		// The field of t.created_at is created_at
+		name := k.Column[strings.LastIndex(k.Column, ".")+1:]
+		f, ok := scope.FieldByName(name)
+		if !ok {
+			return "", de.NewTraceWithMsg(rdb.ErrProcessFailed, "No Field of Sort Column "+k.Column)
+		}
+		values = append(values, f.Field.Interface())
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", de.NewTraceWithMsg(rdb.ErrProcessFailed, err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor reads the values of a cursor, the numbers are kept in json.Number for the precision
+func decodeCursor(cursor string, n int) ([]interface{}, de.AsDroiError) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, de.NewTraceWithMsg(ErrInvalidCursor, err.Error())
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var values []interface{}
+	if err = dec.Decode(&values); err != nil {
+		return nil, de.NewTraceWithMsg(ErrInvalidCursor, err.Error())
+	}
+	if len(values) != n {
+		return nil, de.NewTraceWithMsg(ErrInvalidCursor, "the cursor does not match the sort keys")
+	}
+	for i, v := range values {
+		switch x := v.(type) {
+		case json.Number:
+			// Sent as text, the server casts it to the column type
+			values[i] = string(x)
+		case nil, string, bool:
+		default:
+			return nil, de.NewTraceWithMsg(ErrInvalidCursor, "the cursor has a non-scalar value")
+		}
+	}
+	return values, nil
+}
+
+// KeysetQuery pages the rows of table in the order of keys, from the row after cursor,
+// and returns the cursor of the next page, which is empty at the last page.
+// The cursor is URL safe base64, an empty one starts from the first row.
+// criteria and args filter the rows as CriteriaQuery.
+func (s *Session) KeysetQuery(ctx droictx.Context, ret interface{}, table string, keys []SortKey, cursor string, limit int, criteria string, args ...interface{}) (string, de.AsDroiError) {
+	return keysetQuery(ctx, s, s.conn(), ret, table, keys, cursor, limit, criteria, args...)
+}
+
+func (t *Tx) KeysetQuery(ctx droictx.Context, ret interface{}, table string, keys []SortKey, cursor string, limit int, criteria string, args ...interface{}) (string, de.AsDroiError) {
+	return keysetQuery(ctx, t, t.Conn, ret, table, keys, cursor, limit, criteria, args...)
+}
+
+func (sp *SessionPool) KeysetQuery(ctx droictx.Context, ret interface{}, table string, keys []SortKey, cursor string, limit int, criteria string, args ...interface{}) (next string, err de.AsDroiError) {
+	s, err := sp.getReadSession(ctx)
+	if err != nil {
+		return
+	}
+	defer s.release()
+	return s.KeysetQuery(ctx, ret, table, keys, cursor, limit, criteria, args...)
+}
@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+type keysetRow struct {
+	ID    int64
+	Name  string
+	Score float64
+	Done  bool
+}
+
+// roundTrip encodes the cursor after rows and decodes it back
+func roundTrip(t *testing.T, rows []keysetRow, keys ...SortKey) []interface{} {
+	t.Helper()
+	cursor, err := nextCursor(unreachableSession(t).Conn, &rows, keys, len(rows))
+	if err != nil {
+		t.Fatalf("nextCursor: %v", err)
+	}
+	values, err := decodeCursor(cursor, len(keys))
+	if err != nil {
+		t.Fatalf("decodeCursor(%q): %v", cursor, err)
+	}
+	return values
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	// The cursor is after the last row
+	got := roundTrip(t, []keysetRow{{ID: 1}, {ID: 2}}, SortKey{Column: "id"})
+	if !reflect.DeepEqual(got, []interface{}{"2"}) {
+		t.Errorf("got %#v, want the id of the last row", got)
+	}
+
+	// Numbers travel as strings, a float64 would round 2^53+1
+	got = roundTrip(t, []keysetRow{{ID: 9007199254740993}}, SortKey{Column: "id", Desc: true})
+	if !reflect.DeepEqual(got, []interface{}{"9007199254740993"}) {
+		t.Errorf("big id: got %#v", got)
+	}
+
+	row := keysetRow{ID: 7, Name: "a/b+c?&=", Score: 1.5, Done: true}
+	got = roundTrip(t, []keysetRow{row},
+		SortKey{Column: "t.name"}, SortKey{Column: "t.score", Desc: true}, SortKey{Column: "t.done"}, SortKey{Column: "t.id"})
+	if want := []interface{}{"a/b+c?&=", "1.5", true, "7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("qualified columns: got %#v, want %#v", got, want)
+	}
+}
+
+func TestCursorLastPage(t *testing.T) {
+	db := unreachableSession(t).Conn
+	rows := []keysetRow{{ID: 1}}
+	if cursor, err := nextCursor(db, &rows, []SortKey{{Column: "id"}}, 2); err != nil || cursor != "" {
+		t.Errorf("a short page: got %q, %v, want no cursor", cursor, err)
+	}
+	if _, err := nextCursor(db, &rows, []SortKey{{Column: "missing"}}, 1); err == nil {
+		t.Error("nextCursor takes a sort column without field")
+	}
+}
+
+func TestDecodeInvalidCursor(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	invalid := func(cursor string, n int) {
+		t.Helper()
+		_, err := decodeCursor(cursor, n)
+		if err == nil || err.AsDroiError().ErrorCode() != ErrInvalidCursor.ErrorCode() {
+			t.Errorf("%q: got %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+	invalid("!!!", 1)
+	// Only the unpadded encoding of encodeCursor is taken
+	invalid(base64.URLEncoding.EncodeToString([]byte("[1,2]")), 2)
+	invalid(encode("not json"), 1)
+	invalid(encode(`{"a":1}`), 1)
+	invalid(encode("[1]"), 2)
+	invalid(encode(`[{"a":1}]`), 1)
+
+	if _, err := decodeCursor(encode("[1,2]"), 2); err != nil {
+		t.Errorf("a valid cursor: %v", err)
+	}
+}
+
+func TestKeysetCond(t *testing.T) {
+	cond, args := keysetCond([]SortKey{{Column: "id"}}, []interface{}{"5"})
+	if cond != "(id > ?)" || !reflect.DeepEqual(args, []interface{}{"5"}) {
+		t.Errorf("one key: got %q %v", cond, args)
+	}
+
+	// A descending key compares with <, the keys before it are bound again for each term
+	cond, args = keysetCond([]SortKey{{Column: "created_at", Desc: true}, {Column: "id"}}, []interface{}{"2020-01-01", "5"})
+	if want := "(created_at < ?) OR (created_at = ? AND id > ?)"; cond != want {
+		t.Errorf("got %q, want %q", cond, want)
+	}
+	if want := []interface{}{"2020-01-01", "2020-01-01", "5"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("got args %v, want %v", args, want)
+	}
+
+	// n keys make n terms and n(n+1)/2 args
+	cond, args = keysetCond([]SortKey{{Column: "a"}, {Column: "b"}, {Column: "c", Desc: true}}, []interface{}{1, 2, 3})
+	if want := "(a > ?) OR (a = ? AND b > ?) OR (a = ? AND b = ? AND c < ?)"; cond != want {
+		t.Errorf("got %q, want %q", cond, want)
+	}
+	if len(args) != 6 {
+		t.Errorf("got %d args, want 6", len(args))
+	}
+}
@@ -18,6 +18,8 @@ const (
 	DB_COMMAND_FIELD         = "Dc"
 	DB_COMMAND_TIME_FIELD    = "Dct"
 	REQUEST_TIME_FIELD       = "Rt"
+	TX_ATTEMPT_FIELD         = "Dta"
+	CONNECT_ATTEMPT_FIELD    = "Dca"
 )
 
 func SpentTime(t time.Time) int64 {
@@ -28,13 +30,38 @@ func SpentTime(t time.Time) int64 {
 	return (d.Nanoseconds() / 1e6) + 1
 }
 
-func sqlLog(ctx droictx.Context, dbName, sql string, start time.Time) {
-
+// sqlLog returns the spent time it logged, in milliseconds
+func sqlLog(ctx droictx.Context, dbName, sql string, start time.Time) int64 {
+	spent := SpentTime(start)
 	droipkg.GetLogger().WithMap(ctx.Map()).
 		WithField(DB_COMMAND_FIELD, sql).
 		WithField(DB_HOSTNAME_FIELD, dbName).
-		WithField(DB_COMMAND_TIME_FIELD, SpentTime(start)).
+		WithField(DB_COMMAND_TIME_FIELD, spent).
 		Error("NOERR")
+	return spent
+}
+
+func retryLog(ctx droictx.Context, dbName string, attempt int, err error) {
+	droipkg.GetLogger().WithMap(ctx.Map()).
+		WithField(DB_COMMAND_FIELD, "RETRY TRANSACTION").
+		WithField(DB_HOSTNAME_FIELD, dbName).
+		WithField(TX_ATTEMPT_FIELD, attempt).
+		Warn(err.Error())
+}
+
+// connectLog takes the conninfo with the password redacted
+func connectLog(dbName string, attempt int, conninfo string, err error) {
+	droipkg.GetLogger().
+		WithField(DB_COMMAND_FIELD, conninfo).
+		WithField(DB_HOSTNAME_FIELD, dbName).
+		WithField(CONNECT_ATTEMPT_FIELD, attempt).
+		Warn(err.Error())
+}
+
+func reloadLog(path string, err error) {
+	droipkg.GetLogger().
+		WithField(DB_COMMAND_FIELD, "RELOAD "+path).
+		Error(err.Error())
 }
 
 func debug(args ...interface{}) {
@@ -0,0 +1,123 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/DroiTaipei/droictx"
+	de "github.com/DroiTaipei/droipkg"
+)
+
+// The functions of this file are the package-level ones for the pool registered under name,
+// they return ErrPoolNotFound while there is no such pool.
+
+func OneRecordOn(ctx droictx.Context, name string, ret interface{}, whereClause string, args ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.OneRecord(ctx, ret, whereClause, args...)
+}
+
+func SQLQueryOn(ctx droictx.Context, name string, ret interface{}, querySql string, args ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.SQLQuery(ctx, ret, querySql, args...)
+}
+
+func CriteriaQueryOn(ctx droictx.Context, name string, ret interface{}, order string, limit, offset int, criteria string, args ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.CriteriaQuery(ctx, ret, order, limit, offset, criteria, args...)
+}
+
+func CriteriaCountOn(ctx droictx.Context, name string, model interface{}, ret *int, criteria string, args ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.CriteriaCount(ctx, model, ret, criteria, args...)
+}
+
+func InsertOn(ctx droictx.Context, name string, ret interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.Insert(ctx, ret)
+}
+
+func UpdateOn(ctx droictx.Context, name string, ret interface{}, fields map[string]interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.Update(ctx, ret, fields)
+}
+
+func CriteriaUpdateOn(ctx droictx.Context, name string, ret interface{}, fields map[string]interface{}, criteria string, args ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.CriteriaUpdate(ctx, ret, fields, criteria, args...)
+}
+
+func DeleteOn(ctx droictx.Context, name string, ret interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.Delete(ctx, ret)
+}
+
+func CriteriaDeleteOn(ctx droictx.Context, name string, ret interface{}, criteria string, args ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.CriteriaDelete(ctx, ret, criteria, args...)
+}
+
+func ExecuteOn(ctx droictx.Context, name string, sql string, values ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.Execute(ctx, sql, values...)
+}
+
+func WithTxOn(ctx droictx.Context, name string, fn func(tx *Tx) error, opts ...TxOptions) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.WithTx(ctx, fn, opts...)
+}
+
+func RowScanArgsOn(ctx droictx.Context, name string, sql string, args []interface{}, ptrs ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.RowScanArgs(ctx, sql, args, ptrs...)
+}
+
+func EachRowOn(ctx droictx.Context, name string, querySql string, fn func(*sql.Rows) error, args ...interface{}) (err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.EachRow(ctx, querySql, fn, args...)
+}
+
+func KeysetQueryOn(ctx droictx.Context, name string, ret interface{}, table string, keys []SortKey, cursor string, limit int, criteria string, args ...interface{}) (next string, err de.AsDroiError) {
+	sp, err := lookup(name)
+	if err != nil {
+		return
+	}
+	return sp.KeysetQuery(ctx, ret, table, keys, cursor, limit, criteria, args...)
+}
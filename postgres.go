@@ -1,44 +1,192 @@
 package postgres
 
-import "github.com/DroiTaipei/droipkg"
+import (
+	"sync"
+
+	"github.com/DroiTaipei/droipkg"
+)
 
 var (
+	// stdPool is the DEFAULT_POOL, for the package-level functions
 	stdPool *SessionPool
+	poolsMu sync.RWMutex
+	pools   = map[string]*SessionPool{}
 )
 
 const (
-	DB_TYPE_POSTGRES = "pg"
-	SINGLE_MODE      = "SINGLE"
-	ROUND_ROBIN_MODE = "ROUNDROBIN"
+	DB_TYPE_POSTGRES     = "pg"
+	SINGLE_MODE          = "SINGLE"
+	ROUND_ROBIN_MODE     = "ROUNDROBIN"
+	PRIMARY_REPLICA_MODE = "PRIMARYREPLICA"
+	LEAST_CONN_MODE      = "LEASTCONN"
+	LATENCY_MODE         = "LATENCY"
+	ROLE_PRIMARY         = "PRIMARY"
+	ROLE_REPLICA         = "REPLICA"
+	DEFAULT_POOL         = "default"
 )
 
+// initDefault initializes a new pool by init, and makes it the DEFAULT_POOL in place of the former one,
+// which is closed. As Register, the new pool is not kept while it fails to initialize.
+func initDefault(init func(sp *SessionPool) error) error {
+	sp := &SessionPool{}
+	if err := init(sp); err != nil {
+		sp.Close()
+		return err
+	}
+	poolsMu.Lock()
+	old := pools[DEFAULT_POOL]
+	pools[DEFAULT_POOL] = sp
+	stdPool = sp
+	poolsMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// std is the stdPool, nil before the DEFAULT_POOL is set
+func std() *SessionPool {
+	poolsMu.RLock()
+	defer poolsMu.RUnlock()
+	return stdPool
+}
+
 func Initialize(infos []*DBInfo, accessTarget string) error {
-	stdPool = &SessionPool{}
-	return stdPool.Initialize(infos, accessTarget)
+	return initDefault(func(sp *SessionPool) error {
+		return sp.Initialize(infos, accessTarget)
+	})
 }
 
 func ConnectOne(info *DBInfo) error {
-	stdPool = &SessionPool{}
-	stdPool.SingleMode(info)
-	return nil
+	if err := info.Validate(); err != nil {
+		return err
+	}
+	return initDefault(func(sp *SessionPool) error {
+		return sp.SingleMode(info)
+	})
 }
 
 func RoundRobin(infos []*DBInfo) error {
-	stdPool = &SessionPool{}
-	stdPool.RoundRobinMode(infos)
+	if err := validateInfos(infos); err != nil {
+		return err
+	}
+	return initDefault(func(sp *SessionPool) error {
+		return sp.RoundRobinMode(infos)
+	})
+}
+
+func PrimaryReplica(infos []*DBInfo) error {
+	return initDefault(func(sp *SessionPool) error {
+		return sp.PrimaryReplicaMode(infos)
+	})
+}
+
+// Register initializes a pool as SessionPool.Initialize, and keeps it under name,
+// mode is ROUND_ROBIN_MODE, PRIMARY_REPLICA_MODE, LEAST_CONN_MODE, LATENCY_MODE
+// or the Name of an info for SINGLE_MODE.
+// The pool registered as DEFAULT_POOL serves the package-level functions.
+// The pool is not kept while it fails to initialize.
+func Register(name string, infos []*DBInfo, mode string) error {
+	sp := &SessionPool{}
+	poolsMu.Lock()
+	if _, existed := pools[name]; existed {
+		poolsMu.Unlock()
+		return droipkg.NewError("Register Failed: Pool " + name + " Existed")
+	}
+	pools[name] = sp
+	if name == DEFAULT_POOL {
+		stdPool = sp
+	}
+	poolsMu.Unlock()
+	if err := sp.Initialize(infos, mode); err != nil {
+		poolsMu.Lock()
+		if pools[name] == sp {
+			delete(pools, name)
+			if name == DEFAULT_POOL {
+				stdPool = nil
+			}
+		}
+		poolsMu.Unlock()
+		sp.Close()
+		return err
+	}
+	return nil
+}
+
+// Pool is the pool registered under name, it returns ErrPoolNotFound if there is none
+func Pool(name string) (*SessionPool, error) {
+	sp, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+func lookup(name string) (*SessionPool, droipkg.AsDroiError) {
+	poolsMu.RLock()
+	defer poolsMu.RUnlock()
+	sp, ok := pools[name]
+	if !ok {
+		return nil, droipkg.NewTraceWithMsg(ErrPoolNotFound, "There is no pool "+name)
+	}
+	return sp, nil
+}
+
+// Unregister closes the pool of name, and forgets it
+func Unregister(name string) {
+	poolsMu.Lock()
+	sp := pools[name]
+	delete(pools, name)
+	if name == DEFAULT_POOL {
+		stdPool = nil
+	}
+	poolsMu.Unlock()
+	if sp != nil {
+		sp.Close()
+	}
+}
+
+// ReconnectPool is Reconnect for the pool of name
+func ReconnectPool(name string) error {
+	sp, err := Pool(name)
+	if err != nil {
+		return err
+	}
+	sp.Reconnect()
 	return nil
 }
 
+// ClosePool is Close for the pool of name, it is still registered
+func ClosePool(name string) {
+	if sp, err := Pool(name); err == nil {
+		sp.Close()
+	}
+}
+
+// CloseAll closes every registered pool
+func CloseAll() {
+	poolsMu.RLock()
+	ps := make([]*SessionPool, 0, len(pools))
+	for _, sp := range pools {
+		ps = append(ps, sp)
+	}
+	poolsMu.RUnlock()
+	for _, sp := range ps {
+		sp.Close()
+	}
+}
+
 func Reconnect() error {
-	if stdPool == nil {
+	sp := std()
+	if sp == nil {
 		return droipkg.NewError("There is no alived for reconnecting")
 	}
-	stdPool.Reconnect()
+	sp.Reconnect()
 	return nil
 }
 
 func Close() {
-	if stdPool != nil {
-		stdPool.Close()
+	if sp := std(); sp != nil {
+		sp.Close()
 	}
 }
@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"testing"
+)
+
+func TestRegisterFailureForgetsPool(t *testing.T) {
+	err := Register("unreachable", []*DBInfo{unreachableInfo("a")}, ROUND_ROBIN_MODE)
+	if err == nil {
+		t.Fatal("Register succeeds while no endpoint connected")
+	}
+	if _, err := Pool("unreachable"); err == nil {
+		t.Error("the failed pool is still registered")
+	}
+	if err := ExecuteOn(nil, "unreachable", "SELECT 1"); err == nil || err.AsDroiError().ErrorCode() != ErrPoolNotFound.ErrorCode() {
+		t.Errorf("ExecuteOn got %v, want ErrPoolNotFound", err)
+	}
+}
+
+func TestInitializeReplacesDefault(t *testing.T) {
+	defer Unregister(DEFAULT_POOL)
+	old := &SessionPool{mode: ROUND_ROBIN_MODE}
+	s := workableSession("old", "")
+	s.startHealthCheck()
+	old.AddEndPoint(s)
+	poolsMu.Lock()
+	pools[DEFAULT_POOL] = old
+	stdPool = old
+	poolsMu.Unlock()
+
+	// A failed Initialize keeps neither the new pool nor its goroutines, the former default serves on
+	if err := RoundRobin([]*DBInfo{unreachableInfo("a")}); err == nil {
+		t.Fatal("RoundRobin succeeds while no endpoint connected")
+	}
+	if std() != old {
+		t.Fatal("a failed RoundRobin replaces the default pool")
+	}
+
+	// A replaced default is closed
+	if err := initDefault(func(*SessionPool) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if std() == old {
+		t.Fatal("the default pool is not replaced")
+	}
+	s.hcMu.Lock()
+	running := s.hcStop != nil
+	s.hcMu.Unlock()
+	if running {
+		t.Error("the health checking of the replaced pool is still running")
+	}
+}
@@ -0,0 +1,288 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	de "github.com/DroiTaipei/droipkg"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// PoolConfig is the config file of ReloadConfig and WatchConfig,
+// in YAML for the .yaml and .yml extensions, and in JSON for the others.
+type PoolConfig struct {
+	Mode      string           `json:"mode" yaml:"mode"`
+	EndPoints []EndPointConfig `json:"endpoints" yaml:"endpoints"`
+}
+
+// EndPointConfig is a DBInfo in the config file, the durations are in time.ParseDuration format
+type EndPointConfig struct {
+	Name              string `json:"name" yaml:"name"`
+	Host              string `json:"host" yaml:"host"`
+	Port              int    `json:"port" yaml:"port"`
+	Database          string `json:"database" yaml:"database"`
+	User              string `json:"user" yaml:"user"`
+	Password          string `json:"password" yaml:"password"`
+	Role              string `json:"role" yaml:"role"`
+	MaxConn           int    `json:"max_conn" yaml:"max_conn"`
+	MaxIdle           int    `json:"max_idle" yaml:"max_idle"`
+	Weight            int    `json:"weight" yaml:"weight"`
+	HCInterval        string `json:"hc_interval" yaml:"hc_interval"`
+	StatementTimeout  string `json:"statement_timeout" yaml:"statement_timeout"`
+	SSLMode           string `json:"sslmode" yaml:"sslmode"`
+	SSLRootCert       string `json:"sslrootcert" yaml:"sslrootcert"`
+	SSLCert           string `json:"sslcert" yaml:"sslcert"`
+	SSLKey            string `json:"sslkey" yaml:"sslkey"`
+	SSLServerName     string `json:"sslservername" yaml:"sslservername"`
+	HealthQuery       string `json:"health_query" yaml:"health_query"`
+	MaxReplicationLag string `json:"max_replication_lag" yaml:"max_replication_lag"`
+	// Retry and Breaker keep the running ones of the endpoint while they are omitted
+	Retry   *RetryConfig       `json:"retry" yaml:"retry"`
+	Breaker *BreakerFileConfig `json:"breaker" yaml:"breaker"`
+}
+
+// RetryConfig is a RetryPolicy in the config file
+type RetryConfig struct {
+	MaxAttempts    int     `json:"max_attempts" yaml:"max_attempts"`
+	InitialBackoff string  `json:"initial_backoff" yaml:"initial_backoff"`
+	MaxBackoff     string  `json:"max_backoff" yaml:"max_backoff"`
+	Jitter         float64 `json:"jitter" yaml:"jitter"`
+	Deadline       string  `json:"deadline" yaml:"deadline"`
+	ConnectTimeout string  `json:"connect_timeout" yaml:"connect_timeout"`
+	FailFast       bool    `json:"fail_fast" yaml:"fail_fast"`
+}
+
+// BreakerFileConfig is a BreakerConfig in the config file
+type BreakerFileConfig struct {
+	Window         string  `json:"window" yaml:"window"`
+	Buckets        int     `json:"buckets" yaml:"buckets"`
+	MinRequests    int     `json:"min_requests" yaml:"min_requests"`
+	FailureRate    float64 `json:"failure_rate" yaml:"failure_rate"`
+	OpenTimeout    string  `json:"open_timeout" yaml:"open_timeout"`
+	HalfOpenProbes int     `json:"half_open_probes" yaml:"half_open_probes"`
+}
+
+// durations parses the durations of the fields in order, empty ones are left 0
+func durations(name string, fields []string, values []string, ds ...*time.Duration) error {
+	for i, v := range values {
+		if len(v) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return de.NewError("Invalid Pool Config: " + fields[i] + " of " + name + ", " + err.Error())
+		}
+		*ds[i] = d
+	}
+	return nil
+}
+
+// LoadPoolConfig reads and checks the config file of path
+func LoadPoolConfig(path string) (*PoolConfig, []*DBInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parsePoolConfig(path, data)
+}
+
+func parsePoolConfig(path string, data []byte) (*PoolConfig, []*DBInfo, error) {
+	cfg := &PoolConfig{}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, cfg)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	}
+	if err != nil {
+		return nil, nil, de.NewError("Invalid Pool Config " + path + ": " + err.Error())
+	}
+	infos, err := cfg.infos()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, infos, nil
+}
+
+func (cfg *PoolConfig) infos() ([]*DBInfo, error) {
+	if len(cfg.EndPoints) == 0 {
+		return nil, de.NewError("Invalid Pool Config: Empty EndPoints")
+	}
+	names := map[string]bool{}
+	infos := make([]*DBInfo, 0, len(cfg.EndPoints))
+	for _, ep := range cfg.EndPoints {
+		if len(ep.Name) == 0 || names[ep.Name] {
+			return nil, de.NewError("Invalid Pool Config: Empty or Duplicated Name " + ep.Name)
+		}
+		names[ep.Name] = true
+		info := &DBInfo{
+			Name:          ep.Name,
+			Host:          ep.Host,
+			Port:          ep.Port,
+			Database:      ep.Database,
+			User:          ep.User,
+			Password:      ep.Password,
+			Role:          strings.ToUpper(ep.Role),
+			MaxConn:       ep.MaxConn,
+			MaxIdle:       ep.MaxIdle,
+			Weight:        ep.Weight,
+			SSLMode:       ep.SSLMode,
+			SSLRootCert:   ep.SSLRootCert,
+			SSLCert:       ep.SSLCert,
+			SSLKey:        ep.SSLKey,
+			SSLServerName: ep.SSLServerName,
+			HealthQuery:   ep.HealthQuery,
+		}
+		if info.Port == 0 {
+			info.Port = DEFAULT_PORT
+		}
+		err := durations(ep.Name, []string{"hc_interval", "statement_timeout", "max_replication_lag"},
+			[]string{ep.HCInterval, ep.StatementTimeout, ep.MaxReplicationLag},
+			&info.HCInterval, &info.StatementTimeout, &info.MaxReplicationLag)
+		if err != nil {
+			return nil, err
+		}
+		if r := ep.Retry; r != nil {
+			info.Retry = RetryPolicy{MaxAttempts: r.MaxAttempts, Jitter: r.Jitter, FailFast: r.FailFast}
+			err = durations(ep.Name, []string{"retry.initial_backoff", "retry.max_backoff", "retry.deadline", "retry.connect_timeout"},
+				[]string{r.InitialBackoff, r.MaxBackoff, r.Deadline, r.ConnectTimeout},
+				&info.Retry.InitialBackoff, &info.Retry.MaxBackoff, &info.Retry.Deadline, &info.Retry.ConnectTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if b := ep.Breaker; b != nil {
+			info.Breaker = BreakerConfig{Buckets: b.Buckets, MinRequests: b.MinRequests, FailureRate: b.FailureRate, HalfOpenProbes: b.HalfOpenProbes}
+			err = durations(ep.Name, []string{"breaker.window", "breaker.open_timeout"},
+				[]string{b.Window, b.OpenTimeout}, &info.Breaker.Window, &info.Breaker.OpenTimeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+		infos = append(infos, info)
+	}
+	if err := validateInfos(infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// ReloadConfig applies the config file of path by ReplaceEndPoints.
+// The mode of the file must be the mode of the pool, and a bad file leaves the pool as it was.
+func (sp *SessionPool) ReloadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return sp.applyConfig(path, data)
+}
+
+func (sp *SessionPool) applyConfig(path string, data []byte) error {
+	cfg, infos, err := parsePoolConfig(path, data)
+	if err != nil {
+		return err
+	}
+	if cfg.Mode != sp.mode {
+		return de.NewError("Invalid Pool Config: mode " + cfg.Mode + " differs from the running " + sp.mode)
+	}
+	sp.keepRunning(cfg, infos)
+	return sp.ReplaceEndPoints(infos)
+}
+
+// keepRunning takes Retry and Breaker of the running sessions for the endpoints which omit them,
+// so they are neither reset nor make the sessions reconnect
+func (sp *SessionPool) keepRunning(cfg *PoolConfig, infos []*DBInfo) {
+	current := map[string]*Session{}
+	for _, s := range sp.endPoints() {
+		current[s.Name] = s
+	}
+	for i, ep := range cfg.EndPoints {
+		s, ok := current[ep.Name]
+		if !ok {
+			continue
+		}
+		cur := s.info()
+		if ep.Retry == nil {
+			infos[i].Retry = cur.Retry
+		}
+		if ep.Breaker == nil {
+			infos[i].Breaker = cur.Breaker
+		}
+	}
+}
+
+// WatchConfig applies the config file of path, and re-applies it while it changes,
+// polling every interval until Close. A bad file is logged and skipped.
+func (sp *SessionPool) WatchConfig(path string, interval time.Duration) error {
+	if interval <= 0 {
+		return de.NewError("Watch Config Failed: interval must be positive")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = sp.applyConfig(path, data); err != nil {
+		return err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	sp.mu.Lock()
+	if sp.watchStop != nil {
+		close(sp.watchStop)
+	}
+	sp.watchStop = stop
+	sp.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		modTime, last := stat.ModTime(), data
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			st, err := os.Stat(path)
+			if err != nil || st.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = st.ModTime()
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				reloadLog(path, err)
+				continue
+			}
+			if bytes.Equal(data, last) {
+				continue
+			}
+			if err = sp.applyConfig(path, data); err != nil {
+				reloadLog(path, err)
+				continue
+			}
+			last = data
+		}
+	}()
+	return nil
+}
+
+func (sp *SessionPool) stopWatch() {
+	sp.mu.Lock()
+	if sp.watchStop != nil {
+		close(sp.watchStop)
+		sp.watchStop = nil
+	}
+	sp.mu.Unlock()
+}
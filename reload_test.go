@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+)
+
+const reloadYAML = `
+mode: ROUNDROBIN
+endpoints:
+  - name: a
+    host: 127.0.0.1
+    port: 5432
+    database: test
+    user: test
+    max_conn: 1
+    max_idle: 1
+  - name: b
+    host: 127.0.0.2
+    port: 5432
+    database: test
+    user: test
+    max_conn: 1
+    max_idle: 1
+    retry:
+      max_attempts: 2
+      connect_timeout: 3s
+    breaker:
+      min_requests: 7
+      open_timeout: 20s
+`
+
+func TestParsePoolConfigRetryBreaker(t *testing.T) {
+	_, infos, err := parsePoolConfig("pool.yaml", []byte(reloadYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos[0].Retry != (RetryPolicy{}) || infos[0].Breaker != (BreakerConfig{}) {
+		t.Errorf("a: retry %+v, breaker %+v, want zero", infos[0].Retry, infos[0].Breaker)
+	}
+	b := infos[1]
+	if b.Retry.MaxAttempts != 2 || b.Retry.ConnectTimeout != 3*time.Second {
+		t.Errorf("b: retry %+v", b.Retry)
+	}
+	if b.Breaker.MinRequests != 7 || b.Breaker.OpenTimeout != 20*time.Second {
+		t.Errorf("b: breaker %+v", b.Breaker)
+	}
+
+	bad := []byte(`{"mode":"ROUNDROBIN","endpoints":[{"name":"a","retry":{"deadline":"soon"}}]}`)
+	if _, _, err := parsePoolConfig("pool.json", bad); err == nil {
+		t.Error("a bad retry deadline is accepted")
+	}
+}
+
+func TestReloadKeepsRunningRetryBreaker(t *testing.T) {
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	retry := RetryPolicy{MaxAttempts: 9, ConnectTimeout: 4 * time.Second}
+	breaker := BreakerConfig{MinRequests: 11}
+	for _, name := range []string{"a", "b"} {
+		s := workableSession(name, "")
+		s.Host, s.Port, s.Database, s.User = "127.0.0.1", 5432, "test", "test"
+		if name == "b" {
+			s.Host = "127.0.0.2"
+		}
+		s.Retry, s.Breaker = retry, breaker
+		sp.AddEndPoint(s)
+	}
+
+	cfg, infos, err := parsePoolConfig("pool.yaml", []byte(reloadYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.keepRunning(cfg, infos)
+
+	// a omits both, so nothing changes and the session is kept
+	if infos[0].Retry != retry || infos[0].Breaker != breaker {
+		t.Errorf("a: retry %+v, breaker %+v, want the running ones", infos[0].Retry, infos[0].Breaker)
+	}
+	cur := sp.endPoints()[0].info()
+	if !sameConnection(&cur, infos[0]) {
+		t.Error("a: reloading an unchanged endpoint reconnects it")
+	}
+	// b sets both, the file wins
+	if infos[1].Retry.MaxAttempts != 2 || infos[1].Breaker.MinRequests != 7 {
+		t.Errorf("b: retry %+v, breaker %+v, want the file ones", infos[1].Retry, infos[1].Breaker)
+	}
+}
+
+func TestWatchConfigInterval(t *testing.T) {
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := sp.WatchConfig("pool.yaml", interval); err == nil {
+			t.Errorf("interval %v is accepted", interval)
+		}
+	}
+}
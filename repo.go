@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"github.com/DroiTaipei/droictx"
+)
+
+// Repo is the typed access of the gorm model T on a SessionPool,
+// the errors are the de.AsDroiError of CheckDatabaseError
+type Repo[T any] struct {
+	sp *SessionPool
+	// Key is the primary key column of Get, Update and Delete, "id" by NewRepo
+	Key string
+}
+
+// Filter is the criteria, order and paging of Find, Count and Exists,
+// Where takes ? as the placeholder of Args, and Limit 0 means no limit
+type Filter struct {
+	Where  string
+	Args   []interface{}
+	Order  string
+	Limit  int
+	Offset int
+}
+
+func NewRepo[T any](sp *SessionPool) *Repo[T] {
+	return &Repo[T]{sp: sp, Key: "id"}
+}
+
+// Get is the record of id, rdb.ErrDataNotFound while there is none
+func (r *Repo[T]) Get(ctx droictx.Context, id interface{}) (T, error) {
+	var ret T
+	if err := r.sp.OneRecord(ctx, &ret, r.Key+" = ?", id); err != nil {
+		var zero T
+		return zero, err
+	}
+	return ret, nil
+}
+
+func (r *Repo[T]) Find(ctx droictx.Context, filter Filter) ([]T, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		// gorm takes -1 as no limit
+		limit = -1
+	}
+	ret := []T{}
+	if err := r.sp.CriteriaQuery(ctx, &ret, filter.Order, limit, filter.Offset, filter.Where, filter.Args...); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (r *Repo[T]) Insert(ctx droictx.Context, v *T) error {
+	return r.sp.Insert(ctx, v)
+}
+
+// Update sets the columns of fields on the record of id
+func (r *Repo[T]) Update(ctx droictx.Context, id interface{}, fields map[string]interface{}) error {
+	return r.sp.CriteriaUpdate(ctx, new(T), fields, r.Key+" = ?", id)
+}
+
+func (r *Repo[T]) Delete(ctx droictx.Context, id interface{}) error {
+	return r.sp.CriteriaDelete(ctx, new(T), r.Key+" = ?", id)
+}
+
+// Count ignores Order, Limit and Offset of filter
+func (r *Repo[T]) Count(ctx droictx.Context, filter Filter) (int, error) {
+	var n int
+	if err := r.sp.CriteriaCount(ctx, new(T), &n, filter.Where, filter.Args...); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (r *Repo[T]) Exists(ctx droictx.Context, filter Filter) (bool, error) {
+	n, err := r.Count(ctx, filter)
+	return n > 0, err
+}
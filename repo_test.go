@@ -0,0 +1,144 @@
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	de "github.com/DroiTaipei/droipkg"
+	"github.com/DroiTaipei/droipkg/rdb"
+	"github.com/devopstaku/gorm"
+)
+
+type repoUser struct {
+	ID   int
+	Name string
+}
+
+// recordDriver answers every query with no row, and keeps the statements it was sent
+type recordDriver struct {
+	mu    sync.Mutex
+	stmts []string
+}
+
+func (d *recordDriver) Open(string) (driver.Conn, error) { return recordConn{d}, nil }
+
+func (d *recordDriver) last() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.stmts) == 0 {
+		return ""
+	}
+	return d.stmts[len(d.stmts)-1]
+}
+
+type recordConn struct{ d *recordDriver }
+
+func (c recordConn) Prepare(query string) (driver.Stmt, error) {
+	c.d.mu.Lock()
+	c.d.stmts = append(c.d.stmts, query)
+	c.d.mu.Unlock()
+	return recordStmt{}, nil
+}
+func (c recordConn) Close() error              { return nil }
+func (c recordConn) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+type recordStmt struct{}
+
+func (recordStmt) Close() error                               { return nil }
+func (recordStmt) NumInput() int                              { return -1 }
+func (recordStmt) Exec([]driver.Value) (driver.Result, error) { return driver.RowsAffected(0), nil }
+func (recordStmt) Query([]driver.Value) (driver.Rows, error)  { return noRows{}, nil }
+
+type noRows struct{}
+
+func (noRows) Columns() []string         { return []string{"id", "name"} }
+func (noRows) Close() error              { return nil }
+func (noRows) Next([]driver.Value) error { return io.EOF }
+
+var recordDriverOnce sync.Once
+var records = &recordDriver{}
+
+// recordRepo is a Repo on a pool of one session over recordDriver
+func recordRepo(t *testing.T) *Repo[repoUser] {
+	recordDriverOnce.Do(func() { sql.Register("pgrecord", records) })
+	raw, err := sql.Open("pgrecord", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := gorm.Open("postgres", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := workableSession("a", "")
+	s.Conn = conn
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	sp.AddEndPoint(s)
+	return NewRepo[repoUser](sp)
+}
+
+func TestRepoGetNotFound(t *testing.T) {
+	r := recordRepo(t)
+	r.Key = "uid"
+	u, err := r.Get(newTestCtx(), 7)
+	dErr, ok := err.(de.AsDroiError)
+	if !ok || dErr.AsDroiError().ErrorCode() != rdb.ErrDataNotFound.ErrorCode() {
+		t.Fatalf("Get of no row: %v, want rdb.ErrDataNotFound", err)
+	}
+	if u != (repoUser{}) {
+		t.Errorf("Get returns %+v with the error", u)
+	}
+	if q := records.last(); !strings.Contains(q, "uid = $1") {
+		t.Errorf("Get does not look up by Key: %s", q)
+	}
+}
+
+func TestRepoFindLimit(t *testing.T) {
+	r := recordRepo(t)
+	// No limit maps to gorm -1, a LIMIT 0 would find nothing
+	if _, err := r.Find(newTestCtx(), Filter{Where: "name = ?", Args: []interface{}{"bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if q := records.last(); strings.Contains(q, "LIMIT") {
+		t.Errorf("Find of no limit sends %s", q)
+	}
+	us, err := r.Find(newTestCtx(), Filter{Limit: 5, Order: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if us == nil {
+		t.Error("Find of no row returns nil, want an empty slice")
+	}
+	if q := records.last(); !strings.Contains(q, "LIMIT 5") {
+		t.Errorf("Find of limit 5 sends %s", q)
+	}
+}
+
+func TestRepoUnavailable(t *testing.T) {
+	r := NewRepo[repoUser](&SessionPool{mode: ROUND_ROBIN_MODE})
+	if r.Key != "id" {
+		t.Errorf("Key = %q, want id", r.Key)
+	}
+	// Every call goes through the pool, one is enough to see the error passed on
+	wantUnavailable := func(call string, err error) {
+		dErr, ok := err.(de.AsDroiError)
+		if !ok || dErr.AsDroiError().ErrorCode() != rdb.ErrDatabaseUnavailable.ErrorCode() {
+			t.Errorf("%s: got %v, want rdb.ErrDatabaseUnavailable", call, err)
+		}
+	}
+	us, err := r.Find(newTestCtx(), Filter{})
+	wantUnavailable("Find", err)
+	if us != nil {
+		t.Error("Find returns rows with the error")
+	}
+	ok, err := r.Exists(newTestCtx(), Filter{})
+	wantUnavailable("Exists", err)
+	if ok {
+		t.Error("Exists is true with the error")
+	}
+	wantUnavailable("Delete", r.Delete(newTestCtx(), 1))
+}
@@ -0,0 +1,111 @@
+package postgres
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TxRetryPolicy controls how WithTxRetry re-runs a transaction
+// which failed on serialization failure(40001) or deadlock(40P01).
+type TxRetryPolicy struct {
+	// MaxAttempts includes the first run
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the randomized fraction of each backoff, between 0 and 1
+	Jitter float64
+}
+
+// DefaultTxRetryPolicy fills the zero fields of a TxRetryPolicy
+var DefaultTxRetryPolicy = TxRetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Jitter:         0.2,
+}
+
+func (p TxRetryPolicy) withDefaults() TxRetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultTxRetryPolicy.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultTxRetryPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultTxRetryPolicy.MaxBackoff
+	}
+	return p
+}
+
+// RetryPolicy controls the connecting attempts of a Session
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the randomized fraction of each backoff, between 0 and 1
+	Jitter float64
+	// Deadline bounds all the attempts with their backoffs, 0 means no bound
+	Deadline time.Duration
+	// ConnectTimeout bounds each attempt, 0 means no bound
+	ConnectTimeout time.Duration
+	// FailFast gives up at the first failed attempt
+	FailFast bool
+}
+
+// DefaultRetryPolicy gives up a host which is down in about 10 seconds
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     4 * time.Second,
+	Jitter:         0.2,
+	Deadline:       10 * time.Second,
+}
+
+// withDefaults fills the zero fields, the Deadline is taken only with the MaxAttempts of DefaultRetryPolicy
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+		if p.Deadline <= 0 {
+			p.Deadline = DefaultRetryPolicy.Deadline
+		}
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	return p
+}
+
+var retryableTxCodes = map[pq.ErrorCode]bool{
+	"40001": true,
+	"40P01": true,
+}
+
+func isRetryableTxError(err error) bool {
+	e, ok := err.(*pq.Error)
+	return ok && retryableTxCodes[e.Code]
+}
+
+// backoff is exponential from initial, capped by max, the attempt starts from 1
+func backoff(attempt int, initial, max time.Duration, jitter float64) time.Duration {
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	if jitter > 0 && d > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		delta := float64(d) * jitter
+		d = time.Duration(float64(d) - delta + rand.Float64()*2*delta)
+	}
+	return d
+}
@@ -0,0 +1,94 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestIsRetryableTxError(t *testing.T) {
+	for code, want := range map[pq.ErrorCode]bool{"40001": true, "40P01": true, "23505": false, "57014": false} {
+		if got := isRetryableTxError(&pq.Error{Code: code}); got != want {
+			t.Errorf("%s: got %v, want %v", code, got, want)
+		}
+	}
+	if isRetryableTxError(errors.New("40001")) {
+		t.Error("a plain error is retryable")
+	}
+	if isRetryableTxError(nil) {
+		t.Error("nil is retryable")
+	}
+}
+
+// flaky fails with a serialization failure for the first n calls
+func flaky(n int, calls *int) func() (bool, error) {
+	return func() (bool, error) {
+		*calls++
+		if *calls <= n {
+			return true, &pq.Error{Code: "40001"}
+		}
+		return false, nil
+	}
+}
+
+func TestRetryTxAttempts(t *testing.T) {
+	fast := TxRetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	calls := 0
+	if err := retryTx(newTestCtx(), "a", fast, flaky(2, &calls)); err != nil || calls != 3 {
+		t.Errorf("zero MaxAttempts: %d calls, %v; want 3 calls of DefaultTxRetryPolicy to succeed", calls, err)
+	}
+
+	calls = 0
+	if err := retryTx(newTestCtx(), "a", fast, flaky(5, &calls)); err == nil || calls != DefaultTxRetryPolicy.MaxAttempts {
+		t.Errorf("exhausted: %d calls, %v; want %d calls and the last error", calls, err, DefaultTxRetryPolicy.MaxAttempts)
+	}
+
+	calls = 0
+	fatal := func() (bool, error) { calls++; return false, errors.New("fatal") }
+	if err := retryTx(newTestCtx(), "a", TxRetryPolicy{MaxAttempts: 5}, fatal); err == nil || calls != 1 {
+		t.Errorf("not retryable: %d calls, %v; want 1 call", calls, err)
+	}
+}
+
+func TestRetryTxBackoff(t *testing.T) {
+	// The zero backoff is DefaultTxRetryPolicy.InitialBackoff, not a busy loop
+	calls := 0
+	start := time.Now()
+	retryTx(newTestCtx(), "a", TxRetryPolicy{MaxAttempts: 2}, flaky(1, &calls))
+	if d := time.Since(start); d < DefaultTxRetryPolicy.InitialBackoff/2 {
+		t.Errorf("retried after %v, want about %v", d, DefaultTxRetryPolicy.InitialBackoff)
+	}
+
+	// A done context stops the backoff at once
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	start = time.Now()
+	err := retryTx(WithContext(newTestCtx(), c), "a", TxRetryPolicy{MaxAttempts: 5, InitialBackoff: time.Minute}, flaky(5, &calls))
+	if err == nil || calls != 1 || time.Since(start) > time.Second {
+		t.Errorf("canceled: %d calls in %v, %v; want 1 call and the error", calls, time.Since(start), err)
+	}
+}
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	p := RetryPolicy{}.withDefaults()
+	if p.Deadline != DefaultRetryPolicy.Deadline || p.MaxAttempts != DefaultRetryPolicy.MaxAttempts {
+		t.Errorf("zero policy: %+v, want DefaultRetryPolicy", p)
+	}
+	// The worst case of the default policy stays around its deadline
+	var total time.Duration
+	for attempt := 1; attempt < p.MaxAttempts; attempt++ {
+		total += backoff(attempt, p.InitialBackoff, p.MaxBackoff, 0)
+	}
+	if total > p.Deadline {
+		t.Errorf("the default backoffs take %v, over the deadline %v", total, p.Deadline)
+	}
+	// A policy of the caller keeps its unbounded Deadline
+	if p = (RetryPolicy{MaxAttempts: 3}).withDefaults(); p.Deadline != 0 {
+		t.Errorf("custom policy: Deadline %v, want 0", p.Deadline)
+	}
+}
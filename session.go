@@ -7,6 +7,11 @@ import (
 	de "github.com/DroiTaipei/droipkg"
 	"github.com/devopstaku/gorm"
 	_ "github.com/lib/pq"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,71 +24,270 @@ type DBInfo struct {
 	Database string
 	User     string
 	Password string
+	// Role is ROLE_PRIMARY or ROLE_REPLICA, only used in PRIMARY_REPLICA_MODE
+	Role string
 	// Health Checking Time Interval
 	HCInterval time.Duration
+	// StatementTimeout is the default statement_timeout of every connection, 0 means no timeout
+	StatementTimeout time.Duration
+	// SSLMode is one of SSL_DISABLE, SSL_REQUIRE, SSL_VERIFY_CA and SSL_VERIFY_FULL, SSL_DISABLE by default
+	SSLMode string
+	// SSLRootCert, SSLCert and SSLKey are file paths in PEM
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+	// SSLServerName is verified against the server certificate instead of Host, in SSL_VERIFY_FULL
+	SSLServerName string
+	// Retry controls the connecting attempts, DefaultRetryPolicy while MaxAttempts is 0
+	Retry RetryPolicy
+	// Weight is the share of the calls in round robin, 1 while it is 0
+	Weight int
+	// Breaker controls the circuit breaker, see BreakerConfig for the defaults
+	Breaker BreakerConfig
+	// HealthQuery is run by the health checking instead of Ping, such as "SELECT 1",
+	// the workable session runs it every HCInterval, or DEFAULT_HC_INTERVAL while HCInterval is 0.
+	HealthQuery string
+	// MaxReplicationLag takes a lagging replica out of the valid list until it catches up,
+	// it is checked every HCInterval, or DEFAULT_HC_INTERVAL while HCInterval is 0.
+	// 0 means no limit.
+	MaxReplicationLag time.Duration
 }
 
 type Session struct {
 	Conn *gorm.DB
 	Type string
 	DBInfo
-	workable bool
-	timer    *time.Timer
-	pool     *SessionPool
-}
-
-func newSession(dbi *DBInfo) *Session {
-	s := &Session{DBInfo: *dbi, Type: DB_TYPE_POSTGRES}
-	s.connect()
-	return s
+	// mu guards Conn, DBInfo and pool, which the health checking and updateInfo change
+	mu sync.RWMutex
+	// breaker decides whether the session is workable
+	breaker *breaker
+	pool    *SessionPool
+	// hcMu guards hcStop and hcKick of the health checking goroutine
+	hcMu   sync.Mutex
+	hcStop chan struct{}
+	hcKick chan struct{}
+	// health is the *healthConfig, lagNanos and lagging are the last replication lag checking
+	health   atomic.Value
+	lagNanos int64
+	lagging  int32
+	// lastCheck is the UnixNano of the last health checking, failures counts the consecutive failures,
+	// and lastErr is the message of the last failure, for Status
+	lastCheck int64
+	failures  int64
+	lastErr   atomic.Value
+	// inflight counts the pool calls running on the session
+	inflight int64
+	// curWeight is the runtime Weight, swrrCurrent is guarded by SessionPool.wmu
+	curWeight   int64
+	swrrCurrent int64
+	// ewmaBits is the float64 bits of the latency EWMA
+	ewmaBits uint64
+	// logMode is the LogMode of Conn, for the handles bound to a context
+	logMode int32
+}
+
+func newSession(dbi *DBInfo) (*Session, error) {
+	s := &Session{DBInfo: *dbi, Type: DB_TYPE_POSTGRES, curWeight: int64(dbi.Weight)}
+	s.breaker = newBreaker(dbi.Breaker.withDefaults(dbi.HCInterval))
+	s.setHealth(dbi)
+	// The health checking starts with Conn set, or with the breaker open to probe
+	err := s.connect()
+	s.startHealthCheck()
+	return s, err
 }
 
 func (s *Session) setPool(sp *SessionPool) {
+	s.mu.Lock()
 	s.pool = sp
+	s.mu.Unlock()
+}
+
+func (s *Session) getPool() *SessionPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pool
+}
+
+// conn is Conn, nil while the session never connected
+func (s *Session) conn() *gorm.DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Conn
+}
+
+// info is a copy of DBInfo
+func (s *Session) info() DBInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.DBInfo
+}
+
+// conninfo is the lib/pq connection string, password is passed in for redacting
+func (s *Session) conninfo(host string, port int, user, password, database string) string {
+	dbi := s.info()
+	connHost := host
+	if len(dbi.SSLServerName) > 0 {
+		connHost = dbi.SSLServerName
+	}
+	conninfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		dsnValue(connHost), port, dsnValue(user), dsnValue(password), dsnValue(database), dbi.sslMode())
+	if len(dbi.SSLRootCert) > 0 {
+		conninfo += " sslrootcert=" + dsnValue(dbi.SSLRootCert)
+	}
+	if len(dbi.SSLCert) > 0 {
+		conninfo += " sslcert=" + dsnValue(dbi.SSLCert) + " sslkey=" + dsnValue(dbi.SSLKey)
+	}
+	if dbi.StatementTimeout > 0 {
+		conninfo += fmt.Sprintf(" statement_timeout=%d", millis(dbi.StatementTimeout))
+	}
+	if dbi.Retry.ConnectTimeout > 0 {
+		// lib/pq takes connect_timeout in seconds
+		conninfo += fmt.Sprintf(" connect_timeout=%d", int64((dbi.Retry.ConnectTimeout+time.Second-1)/time.Second))
+	}
+	return conninfo
 }
 
 func (s *Session) getConnection(host string, port int, user, password, database string, maxIdle, maxConn int) (err error) {
 	var c *gorm.DB
-	conninfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, database)
-	maxAttempts := 20
-	for attempts := 1; attempts <= maxAttempts; attempts++ {
-		c, err = gorm.Open("postgres", conninfo)
+	conninfo := s.conninfo(host, port, user, password, database)
+	redacted := s.conninfo(host, port, user, "******", database)
+	policy := s.info().Retry.withDefaults()
+	start := time.Now()
+	for attempts := 1; ; attempts++ {
+		c, err = s.open(conninfo, host, port, maxIdle, maxConn)
 		if err == nil {
 			break
 		}
-		fmt.Printf("Round %d, Attemp to Connect with %s Failed, with %s\n", attempts, conninfo, err.Error())
-		time.Sleep(time.Duration(attempts) * time.Second)
+		connectLog(s.Name, attempts, redacted, err)
+		if policy.FailFast || attempts >= policy.MaxAttempts {
+			return
+		}
+		wait := backoff(attempts, policy.InitialBackoff, policy.MaxBackoff, policy.Jitter)
+		if policy.Deadline > 0 && time.Since(start)+wait > policy.Deadline {
+			return
+		}
+		time.Sleep(wait)
+	}
+	s.mu.Lock()
+	s.Conn = c
+	s.mu.Unlock()
+	return
+}
+
+// open makes one connecting attempt, the *sql.DB is closed while it can not be used
+func (s *Session) open(conninfo, host string, port int, maxIdle, maxConn int) (c *gorm.DB, err error) {
+	if len(s.info().SSLServerName) == 0 {
+		// gorm closes the *sql.DB it opened itself on failure
+		c, err = gorm.Open("postgres", conninfo)
+	} else {
+		// Dial the real host, while lib/pq verifies the certificate against the server name
+		dialer := addrDialer{addr: net.JoinHostPort(host, strconv.Itoa(port))}
+		db := sql.OpenDB(&dialConnector{conninfo: conninfo, dialer: dialer})
+		if c, err = gorm.Open("postgres", db); err != nil {
+			db.Close()
+		}
 	}
 	if err != nil {
-		return
+		return nil, err
 	}
-
 	c.DB().SetMaxIdleConns(maxIdle)
 	c.DB().SetMaxOpenConns(maxConn)
 	c.Exec("SET TIME ZONE 'UTC';")
-	s.Conn = c
-	return
-}
-
-func (s *Session) connect() bool {
-	err := s.getConnection(s.DBInfo.Host, s.DBInfo.Port, s.DBInfo.User, s.DBInfo.Password, s.DBInfo.Database, s.DBInfo.MaxIdle, s.DBInfo.MaxConn)
+	return c, nil
+}
+
+// sameConnection tells whether a and b connect the same way,
+// the pool parameters like MaxConn are not compared.
+func sameConnection(a, b *DBInfo) bool {
+	return a.Host == b.Host && a.Port == b.Port && a.Database == b.Database &&
+		a.User == b.User && a.Password == b.Password &&
+		a.StatementTimeout == b.StatementTimeout && a.sslMode() == b.sslMode() &&
+		a.SSLRootCert == b.SSLRootCert && a.SSLCert == b.SSLCert && a.SSLKey == b.SSLKey &&
+		a.SSLServerName == b.SSLServerName && a.Retry.ConnectTimeout == b.Retry.ConnectTimeout
+}
+
+// updateInfo applies the pool parameters of info, which connects as the current one,
+// the caller rebuilds the valid list of the pool for the new weight and role
+func (s *Session) updateInfo(info *DBInfo) {
+	s.mu.Lock()
+	if s.Conn != nil {
+		s.Conn.DB().SetMaxIdleConns(info.MaxIdle)
+		s.Conn.DB().SetMaxOpenConns(info.MaxConn)
+	}
+	s.DBInfo.MaxIdle = info.MaxIdle
+	s.DBInfo.MaxConn = info.MaxConn
+	s.DBInfo.HCInterval = info.HCInterval
+	s.DBInfo.Role = info.Role
+	s.DBInfo.Retry = info.Retry
+	s.DBInfo.Weight = info.Weight
+	s.DBInfo.Breaker = info.Breaker
+	s.DBInfo.HealthQuery = info.HealthQuery
+	s.DBInfo.MaxReplicationLag = info.MaxReplicationLag
+	s.mu.Unlock()
+	atomic.StoreInt64(&s.curWeight, int64(info.Weight))
+	s.breaker.configure(info.Breaker.withDefaults(info.HCInterval))
+	s.setHealth(info)
+}
+
+// dsnValue quotes v for the key=value conninfo of lib/pq
+func dsnValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+func (s *Session) connect() error {
+	dbi := s.info()
+	err := s.getConnection(dbi.Host, dbi.Port, dbi.User, dbi.Password, dbi.Database, dbi.MaxIdle, dbi.MaxConn)
 	if err != nil {
-		return false
+		s.failed(err)
+		s.unWorkable()
+		return err
 	}
 	s.checkWorkable()
-	return s.workable
+	return nil
 }
 
 func (s *Session) Close() {
-	s.Conn.Close()
+	s.stopHealthCheck()
+	// Conn is nil while the session never connected
+	if c := s.conn(); c != nil {
+		c.Close()
+	}
 }
 
 func (s *Session) reconnect() bool {
-	tmp := s.Conn
-	defer tmp.Close()
-	s.workable = false
-	return s.connect()
+	tmp := s.conn()
+	err := s.connect()
+	// A failed connect keeps Conn, the health check goes on probing with it
+	if tmp != nil && s.conn() != tmp {
+		tmp.Close()
+	}
+	s.startHealthCheck()
+	return err == nil && s.Workable()
+}
+
+func (s *Session) acquire() {
+	atomic.AddInt64(&s.inflight, 1)
+}
+
+func (s *Session) release() {
+	atomic.AddInt64(&s.inflight, -1)
+}
+
+// drain waits for the in-flight calls until timeout,
+// and for the connections in use, which the rows not closed yet hold after their calls returned
+func (s *Session) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for s.busy() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *Session) busy() bool {
+	if atomic.LoadInt64(&s.inflight) > 0 {
+		return true
+	}
+	c := s.conn()
+	return c != nil && c.DB().Stats().InUse > 0
 }
 
 func (s *Session) setCtx(ctx droictx.Context) {
@@ -91,155 +295,322 @@ func (s *Session) setCtx(ctx droictx.Context) {
 	ctx.Set(DB_HOSTNAME_FIELD, s.Name)
 }
 
+// recordSuccess counts a call which reached the server
+func (s *Session) recordSuccess() {
+	atomic.StoreInt64(&s.failures, 0)
+	if s.breaker.success() {
+		debug(s.Name, " is Workable!")
+		s.eventToPool(EVENT_RECOVERED, "probe succeeded")
+	}
+}
+
+// recordFailure counts a call which could not reach the server,
+// and trips the breaker while the failure rate is over the threshold
+func (s *Session) recordFailure(err error) {
+	s.failed(err)
+	if s.breaker.failure() {
+		s.opened()
+	}
+}
+
+// unWorkable opens the breaker at once, for the failed connecting and health checking
 func (s *Session) unWorkable() {
-	s.workable = false
-	s.eventToPool()
-	go s.check()
+	if s.breaker.to(BREAKER_OPEN) {
+		s.opened()
+	}
+}
+
+func (s *Session) opened() {
+	debug(s.Name, " is Unworkable, breaker opened")
+	cause, _ := s.lastErr.Load().(string)
+	s.eventToPool(EVENT_DOWN, cause)
+	s.hcMu.Lock()
+	if s.hcKick != nil {
+		select {
+		case s.hcKick <- struct{}{}:
+		default:
+			// The goroutine is already kicked
+		}
+	}
+	s.hcMu.Unlock()
 }
 
-func (s *Session) check() {
-	// Avoid Repeated Call v.check
-	// While timer is not nil, it means there is another goroutine
-	if s.timer != nil {
+// startHealthCheck runs the health checking goroutine, unless it is running
+func (s *Session) startHealthCheck() {
+	s.hcMu.Lock()
+	defer s.hcMu.Unlock()
+	if s.hcStop != nil {
 		return
 	}
+	s.hcStop = make(chan struct{})
+	s.hcKick = make(chan struct{}, 1)
+	go s.healthCheck(s.hcStop, s.hcKick)
+}
+
+// stopHealthCheck stops the health checking goroutine
+func (s *Session) stopHealthCheck() {
+	s.hcMu.Lock()
+	defer s.hcMu.Unlock()
+	if s.hcStop != nil {
+		close(s.hcStop)
+		s.hcStop = nil
+		s.hcKick = nil
+	}
+}
 
-	s.timer = time.NewTimer(s.DBInfo.HCInterval)
-	for s.timer != nil {
-		select {
-		case <-s.timer.C:
-			debug(" Checking is ", s.Name, " Workable? ")
-			if s.connect() {
-				s.timer = nil
-				debug(s.Name, " is Workable!")
+// healthCheck probes the server every OpenTimeout while the breaker is open,
+// then waits for the breaker opening again, and returns while stop is closed.
+// With HealthQuery or MaxReplicationLag, it also checks the workable session every HCInterval.
+func (s *Session) healthCheck(stop, kick chan struct{}) {
+	for {
+		for s.breaker.State() == BREAKER_OPEN {
+			timer := time.NewTimer(s.breaker.openTimeout())
+			select {
+			case <-stop:
+				timer.Stop()
 				return
-			} else {
-				s.timer = time.NewTimer(s.DBInfo.HCInterval)
+			case <-timer.C:
+			}
+			s.probe(stop)
+		}
+		var tick <-chan time.Time
+		var ticker *time.Timer
+		if d := s.healthConfig().interval; d > 0 {
+			ticker = time.NewTimer(d)
+			tick = ticker.C
+		}
+		select {
+		case <-stop:
+			if ticker != nil {
+				ticker.Stop()
 			}
+			return
+		case <-kick:
+		case <-tick:
+			// Conn is nil while the session never connected, the probing connects it
+			if s.conn() != nil && s.Workable() && !s.testConnection() {
+				s.unWorkable()
+			}
+		}
+		if ticker != nil {
+			ticker.Stop()
 		}
 	}
-
 }
 
-func (s *Session) enWorkable() {
-	s.workable = true
-	s.eventToPool()
+// probe turns the open breaker half-open while the server answers.
+// The session never connected makes one connecting attempt, which is dropped while stop is closed.
+func (s *Session) probe(stop chan struct{}) {
+	debug(" Checking is ", s.Name, " Workable? ")
+	if s.conn() == nil {
+		dbi := s.info()
+		c, err := s.open(s.conninfo(dbi.Host, dbi.Port, dbi.User, dbi.Password, dbi.Database), dbi.Host, dbi.Port, dbi.MaxIdle, dbi.MaxConn)
+		if err != nil {
+			s.checked(err)
+			return
+		}
+		s.mu.Lock()
+		select {
+		case <-stop:
+			// Closed, Close sees no Conn to close
+			s.mu.Unlock()
+			c.Close()
+			return
+		default:
+		}
+		s.Conn = c
+		s.mu.Unlock()
+	}
+	if s.testConnection() && s.breaker.halfOpen() {
+		s.eventToPool("", "")
+	}
 }
 
-func (s *Session) eventToPool() {
-	if s.pool != nil {
-		s.pool.CheckValidList()
+// eventToPool passes the event of typ to the OnEvent callbacks, unless typ is empty,
+// then rebuilds the valid list of the pool
+func (s *Session) eventToPool(typ, cause string) {
+	if sp := s.getPool(); sp != nil {
+		if len(typ) > 0 {
+			sp.emit(typ, s.Name, cause)
+		}
+		sp.CheckValidList()
 	}
 }
 
+// Workable tells whether the breaker is not open,
+// a half-open session only takes a few probe calls
 func (s *Session) Workable() bool {
-	return s.workable
+	return s.breaker.State() != BREAKER_OPEN
 }
 
-func (s *Session) testConnection() (ret bool) {
-	err := s.Conn.DB().Ping()
-	if err == nil {
-		ret = true
-	}
-	return
+// BreakerState is BREAKER_CLOSED, BREAKER_OPEN or BREAKER_HALF_OPEN
+func (s *Session) BreakerState() string {
+	return s.breaker.State()
 }
+
+// allow admits a call by the breaker
+func (s *Session) allow() bool {
+	return s.breaker.allow()
+}
+
+// checkWorkable closes the breaker while the new connection answers
 func (s *Session) checkWorkable() {
-	if s.testConnection() {
-		s.enWorkable()
+	if !s.testConnection() {
+		s.unWorkable()
+	} else if s.breaker.to(BREAKER_CLOSED) {
+		s.eventToPool(EVENT_RECOVERED, "connected")
 	}
 }
 
-func (s *Session) OneRecord(ctx droictx.Context, ret interface{}, whereClause string, args ...interface{}) (de.AsDroiError) {
+func (s *Session) OneRecord(ctx droictx.Context, ret interface{}, whereClause string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(whereClause, args); err != nil {
+		return err
+	}
+	db, done := s.db(ctx)
+	defer done()
 	where := append([]interface{}{whereClause}, args...)
-	defer sqlLog(ctx, s.DBInfo.Name, whereClause, time.Now())
-	return s.CheckDatabaseError(s.Conn.First(ret, where...).Error)
+	defer s.logSQL(ctx, whereClause, time.Now())
+	return s.CheckDatabaseError(db.First(ret, where...).Error)
+}
+
+func (s *Session) Query(ctx droictx.Context, where, order string, limit, offset int, ret interface{}) de.AsDroiError {
+	return s.CriteriaQuery(ctx, ret, order, limit, offset, where)
 }
 
-func (s *Session) Query(ctx droictx.Context, where, order string, limit, offset int, ret interface{}) (de.AsDroiError) {
-	q := s.Conn
-	if len(where) > 0 {
-		q = q.Where(where)
+// CriteriaQuery is Query with the bind parameters of criteria
+func (s *Session) CriteriaQuery(ctx droictx.Context, ret interface{}, order string, limit, offset int, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	db, done := s.db(ctx)
+	defer done()
+	q := db
+	if len(criteria) > 0 {
+		q = q.Where(criteria, args...)
 	}
 	if len(order) > 0 {
 		q = q.Order(order)
 	}
 	q = q.Offset(offset).Limit(limit)
-	// TODO: Try To GetSQL
-	defer sqlLog(ctx, s.DBInfo.Name, "", time.Now())
-
+	defer s.logSQL(ctx, criteria, time.Now())
 	return s.CheckDatabaseError(q.Find(ret).Error)
 }
 
-func (s *Session) TableQuery(ctx droictx.Context, table, where, order string, limit, offset int, ret interface{}) (de.AsDroiError) {
-	q := s.Conn.Table(table)
-	if len(where) > 0 {
-		q = q.Where(where)
+func (s *Session) TableQuery(ctx droictx.Context, table, where, order string, limit, offset int, ret interface{}) de.AsDroiError {
+	return s.CriteriaTableQuery(ctx, ret, table, order, limit, offset, where)
+}
+
+// CriteriaTableQuery is TableQuery with the bind parameters of criteria
+func (s *Session) CriteriaTableQuery(ctx droictx.Context, ret interface{}, table, order string, limit, offset int, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	db, done := s.db(ctx)
+	defer done()
+	q := db.Table(table)
+	if len(criteria) > 0 {
+		q = q.Where(criteria, args...)
 	}
 	if len(order) > 0 {
 		q = q.Order(order)
 	}
 	q = q.Offset(offset).Limit(limit)
-	// TODO: Try To GetSQL
-	defer sqlLog(ctx, s.DBInfo.Name, "", time.Now())
-
+	defer s.logSQL(ctx, criteria, time.Now())
 	return s.CheckDatabaseError(q.Find(ret).Error)
-	
 }
 
-func (s *Session) SQLQuery(ctx droictx.Context, ret interface{}, querySql string, args ...interface{}) (de.AsDroiError) {
-	defer sqlLog(ctx, s.DBInfo.Name, querySql, time.Now())
-	return s.CheckDatabaseError(s.Conn.Raw(querySql, args ...).Scan(ret).Error)
+func (s *Session) SQLQuery(ctx droictx.Context, ret interface{}, querySql string, args ...interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	defer s.logSQL(ctx, querySql, time.Now())
+	return s.CheckDatabaseError(db.Raw(querySql, args...).Scan(ret).Error)
 }
 
-func (s *Session) WhereQuery(ctx droictx.Context, where interface{}, order string, limit, offset int, ret interface{}) (de.AsDroiError) {
-	tmp := s.Conn.Where(where)
+func (s *Session) WhereQuery(ctx droictx.Context, where interface{}, order string, limit, offset int, ret interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	tmp := db.Where(where)
 	if len(order) > 0 {
 		tmp = tmp.Order(order)
 	}
 	return s.CheckDatabaseError(tmp.Limit(limit).Offset(offset).Find(ret).Error)
-	
+
 }
 
-func (s *Session) Count(ctx droictx.Context, where string, model interface{}, ret *int) (de.AsDroiError) {
-	q := s.Conn
-	if len(where) > 0 {
-		q = q.Where(where)
+func (s *Session) Count(ctx droictx.Context, where string, model interface{}, ret *int) de.AsDroiError {
+	return s.CriteriaCount(ctx, model, ret, where)
+}
+
+// CriteriaCount is Count with the bind parameters of criteria
+func (s *Session) CriteriaCount(ctx droictx.Context, model interface{}, ret *int, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	db, done := s.db(ctx)
+	defer done()
+	q := db
+	if len(criteria) > 0 {
+		q = q.Where(criteria, args...)
 	}
-	defer sqlLog(ctx, s.DBInfo.Name, where, time.Now())
+	defer s.logSQL(ctx, criteria, time.Now())
 	return s.CheckDatabaseError(q.Model(model).Count(ret).Error)
-	
 }
 
-func (s *Session) Insert(ctx droictx.Context, ret interface{}) (de.AsDroiError) {
-	return s.CheckDatabaseError(s.Conn.Create(ret).Error)
+func (s *Session) Insert(ctx droictx.Context, ret interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	return s.CheckDatabaseError(db.Create(ret).Error)
 }
 
-func (s *Session) OmitInsert(ctx droictx.Context, ret interface{}, omit string) (de.AsDroiError) {
-	return s.CheckDatabaseError(s.Conn.Omit(omit).Create(ret).Error)
+func (s *Session) OmitInsert(ctx droictx.Context, ret interface{}, omit string) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	return s.CheckDatabaseError(db.Omit(omit).Create(ret).Error)
 }
 
-func (s *Session) Update(ctx droictx.Context, ret interface{}, fields map[string]interface{}) (de.AsDroiError) {
-	return s.CheckDatabaseError(s.Conn.Model(ret).UpdateColumns(fields).Error)
+func (s *Session) Update(ctx droictx.Context, ret interface{}, fields map[string]interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	return s.CheckDatabaseError(db.Model(ret).UpdateColumns(fields).Error)
 }
 
-func (s *Session) UpdateNonBlank(ctx droictx.Context, ret interface{}) (de.AsDroiError) {
-	 return s.CheckDatabaseError(s.Conn.Model(ret).Update(ret).Error)
+func (s *Session) UpdateNonBlank(ctx droictx.Context, ret interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	return s.CheckDatabaseError(db.Model(ret).Update(ret).Error)
 }
 
 func (s *Session) CriteriaUpdate(ctx droictx.Context, ret interface{}, fields map[string]interface{}, criteria string, args ...interface{}) de.AsDroiError {
-	return s.CheckDatabaseError(s.Conn.Model(ret).Where(criteria, args...).UpdateColumns(fields).Error)
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	db, done := s.db(ctx)
+	defer done()
+	return s.CheckDatabaseError(db.Model(ret).Where(criteria, args...).UpdateColumns(fields).Error)
 }
 
-func (s *Session) Delete(ctx droictx.Context, ret interface{}) (de.AsDroiError) {
-	return s.CheckDatabaseError(s.Conn.Delete(ret).Error)
+func (s *Session) Delete(ctx droictx.Context, ret interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	return s.CheckDatabaseError(db.Delete(ret).Error)
 }
 
-func (s *Session) CriteriaDelete(ctx droictx.Context, ret interface{}, criteria string, args ...interface{}) de.AsDroiError  {
-	return s.CheckDatabaseError(s.Conn.Where(criteria, args...).Delete(ret).Error)
+func (s *Session) CriteriaDelete(ctx droictx.Context, ret interface{}, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	db, done := s.db(ctx)
+	defer done()
+	return s.CheckDatabaseError(db.Where(criteria, args...).Delete(ret).Error)
 }
 
-func (s *Session) Join(ctx droictx.Context, ret interface{}, table, fields, join, order, criteria string, args ...interface{}) (de.AsDroiError) {
-	pgErr := s.Conn.
+func (s *Session) Join(ctx droictx.Context, ret interface{}, table, fields, join, order, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	db, done := s.db(ctx)
+	defer done()
+	pgErr := db.
 		Table(table).
 		Select(fields).
 		Joins(join).
@@ -248,35 +619,79 @@ func (s *Session) Join(ctx droictx.Context, ret interface{}, table, fields, join
 		Find(ret).Error
 
 	return s.CheckDatabaseError(pgErr)
-	
+
 }
 
-func (s *Session) Execute(ctx droictx.Context, sql string, values ...interface{}) (de.AsDroiError) {
-	return s.CheckDatabaseError(s.Conn.Exec(sql, values...).Error)
-	
+func (s *Session) Execute(ctx droictx.Context, sql string, values ...interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	return s.CheckDatabaseError(db.Exec(sql, values...).Error)
+
 }
 
-func (s *Session) Transaction(ctx droictx.Context, sqls []string) (de.AsDroiError) {
-	tx := s.Conn.Begin()
-	b := len(sqls)
-	for i := 0; i < b; i++ {
-		rawErr := tx.Exec(sqls[i]).Error
-		if rawErr != nil {
-			tx.Rollback()
-			return s.CheckDatabaseError(rawErr)
-			
+func (s *Session) Transaction(ctx droictx.Context, sqls []string, opts ...TxOptions) de.AsDroiError {
+	return s.WithTx(ctx, func(tx *Tx) error {
+		b := len(sqls)
+		for i := 0; i < b; i++ {
+			if err := tx.Conn.Exec(sqls[i]).Error; err != nil {
+				return err
+			}
 		}
-	}
-	tx.Commit()
-	return nil
+		return nil
+	}, opts...)
 }
 
-func (s *Session) RowScan(ctx droictx.Context, sql string, ptrs ...interface{}) (de.AsDroiError) {
-	return s.CheckDatabaseError(s.Conn.Raw(sql).Row().Scan(ptrs...))
-	
+func (s *Session) RowScan(ctx droictx.Context, sql string, ptrs ...interface{}) de.AsDroiError {
+	return s.RowScanArgs(ctx, sql, nil, ptrs...)
 }
 
-func (s *Session) Rows(ctx droictx.Context, sql string) (rows *sql.Rows, err de.AsDroiError) {
-	rows, rawErr := s.Conn.Raw(sql).Rows()
+// RowScanArgs is RowScan with the bind parameters args
+func (s *Session) RowScanArgs(ctx droictx.Context, sql string, args []interface{}, ptrs ...interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	defer s.logSQL(ctx, sql, time.Now())
+	return s.CheckDatabaseError(db.Raw(sql, args...).Row().Scan(ptrs...))
+}
+
+// Rows leaves the rows to the caller for closing, EachRow closes them itself
+func (s *Session) Rows(ctx droictx.Context, sql string, args ...interface{}) (rows *sql.Rows, err de.AsDroiError) {
+	// The statement timeout of ctx is not applied, since rows outlive this call
+	rows, rawErr := s.ctxConn(ctx).Raw(sql, args...).Rows()
 	return rows, s.CheckDatabaseError(rawErr)
 }
+
+// EachRow runs fn on every row of querySql, and closes the rows in any case.
+// An error of fn stops the iteration, it is returned as is while it is a de.AsDroiError,
+// the other errors of fn and the rows are checked by CheckDatabaseError.
+func (s *Session) EachRow(ctx droictx.Context, querySql string, fn func(*sql.Rows) error, args ...interface{}) de.AsDroiError {
+	db, done := s.db(ctx)
+	defer done()
+	defer s.logSQL(ctx, querySql, time.Now())
+	rows, err := db.Raw(querySql, args...).Rows()
+	if err != nil {
+		return s.CheckDatabaseError(err)
+	}
+	return rowsError(s.CheckDatabaseError, eachRow(rows, fn))
+}
+
+func eachRow(rows *sql.Rows, fn func(*sql.Rows) error) (err error) {
+	defer func() {
+		if closeErr := rows.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return
+		}
+	}
+	return rows.Err()
+}
+
+// rowsError keeps the de.AsDroiError of fn, and checks the others by check
+func rowsError(check func(error) de.AsDroiError, err error) de.AsDroiError {
+	if e, ok := err.(de.AsDroiError); ok {
+		return e
+	}
+	return check(err)
+}
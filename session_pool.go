@@ -2,15 +2,19 @@ package postgres
 
 import (
 	"database/sql"
-	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/DroiTaipei/droictx"
 	de "github.com/DroiTaipei/droipkg"
 	"github.com/DroiTaipei/droipkg/rdb"
 	"github.com/devopstaku/gorm"
-	"sync"
-	"sync/atomic"
 )
 
+// DrainTimeout bounds how long a removed session waits for its in-flight calls before closing
+var DrainTimeout = 30 * time.Second
+
 type SessionPool struct {
 	// hosts are the set of all hosts in the cassandra ring that we know of
 	mu          sync.RWMutex
@@ -19,20 +23,102 @@ type SessionPool struct {
 	pos         uint64
 	mode        string
 	single      *Session
+	// primary is the write target in PRIMARY_REPLICA_MODE
+	primary *Session
+	// watchStop stops the goroutine of WatchConfig
+	watchStop chan struct{}
+	// weighted is set while the valid sessions have different weights
+	weighted bool
+	// wmu guards the smooth weighted round robin state of the sessions
+	wmu sync.Mutex
+	// available is whether any session is workable, for EVENT_UNAVAILABLE
+	available bool
+	// hookMu guards hooks, the callbacks of OnEvent
+	hookMu sync.RWMutex
+	hooks  []func(EndpointEvent)
 }
 
-func (sp *SessionPool) SingleMode(info *DBInfo) {
-	sp.single = newSession(info)
+// SingleMode returns the connecting error, the session is kept even so
+func (sp *SessionPool) SingleMode(info *DBInfo) (err error) {
+	sp.single, err = newSession(info)
 	sp.mode = SINGLE_MODE
+	sp.single.setPool(sp)
+	sp.CheckValidList()
+	return
+}
+
+// RoundRobinMode fails only while no session connected, the failed ones are kept as unworkable
+func (sp *SessionPool) RoundRobinMode(infos []*DBInfo) error {
+	return sp.balanceMode(infos, ROUND_ROBIN_MODE)
+}
+
+// LeastConnMode picks the workable session with the fewest in-flight calls
+func (sp *SessionPool) LeastConnMode(infos []*DBInfo) error {
+	return sp.balanceMode(infos, LEAST_CONN_MODE)
 }
 
-func (sp *SessionPool) RoundRobinMode(infos []*DBInfo) {
+// LatencyMode picks the workable session with the lowest EWMA of query latency
+func (sp *SessionPool) LatencyMode(infos []*DBInfo) error {
+	return sp.balanceMode(infos, LATENCY_MODE)
+}
+
+func (sp *SessionPool) balanceMode(infos []*DBInfo, mode string) error {
+	sp.mode = mode
+	return sp.addEndPoints(infos)
+}
+
+// addEndPoints adds a session for each of infos, the ones failed to connect stay unworkable.
+// It fails only while none of them connected.
+func (sp *SessionPool) addEndPoints(infos []*DBInfo) (err error) {
+	connected := 0
 	b := len(infos)
+	// The hosts are connected at the same time, so the ones down cost one RetryPolicy in all
+	ss := make([]*Session, b)
+	errs := make([]error, b)
+	var wg sync.WaitGroup
 	for i := 0; i < b; i++ {
-		stdPool.AddEndPoint(newSession(infos[i]))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ss[i], errs[i] = newSession(infos[i])
+		}(i)
 	}
-	stdPool.CheckValidList()
-	sp.mode = ROUND_ROBIN_MODE
+	wg.Wait()
+	for i := 0; i < b; i++ {
+		s, connErr := ss[i], errs[i]
+		if connErr != nil {
+			s.unWorkable()
+			err = connErr
+		} else {
+			connected++
+		}
+		sp.AddEndPoint(s)
+	}
+	sp.CheckValidList()
+	if connected > 0 {
+		return nil
+	}
+	return
+}
+
+// PrimaryReplicaMode routes writes to the only ROLE_PRIMARY info,
+// and round-robins reads across the workable replicas.
+func (sp *SessionPool) PrimaryReplicaMode(infos []*DBInfo) error {
+	b := len(infos)
+	primaries := 0
+	for i := 0; i < b; i++ {
+		if infos[i].Role == ROLE_PRIMARY {
+			primaries++
+		}
+	}
+	if primaries != 1 {
+		return de.NewError("Initialize Failed: PRIMARY_REPLICA_MODE needs exactly one primary")
+	}
+	if err := validateInfos(infos); err != nil {
+		return err
+	}
+	sp.mode = PRIMARY_REPLICA_MODE
+	return sp.addEndPoints(infos)
 }
 
 func (sp *SessionPool) Initialize(infos []*DBInfo, accessTarget string) error {
@@ -40,31 +126,31 @@ func (sp *SessionPool) Initialize(infos []*DBInfo, accessTarget string) error {
 	if b == 0 {
 		return de.NewError("Initialize Failed: Empty PG DB Infos")
 	}
-	if accessTarget == ROUND_ROBIN_MODE {
-		sp.RoundRobinMode(infos)
-		return nil
-	} else {
-		for i := 0; i < b; i++ {
-			if infos[i].Name == accessTarget {
-				sp.SingleMode(infos[i])
-				return nil
-			}
+	if err := validateInfos(infos); err != nil {
+		return err
+	}
+	if accessTarget == ROUND_ROBIN_MODE || accessTarget == LEAST_CONN_MODE || accessTarget == LATENCY_MODE {
+		return sp.balanceMode(infos, accessTarget)
+	} else if accessTarget == PRIMARY_REPLICA_MODE {
+		return sp.PrimaryReplicaMode(infos)
+	}
+	for i := 0; i < b; i++ {
+		if infos[i].Name == accessTarget {
+			return sp.SingleMode(infos[i])
 		}
-
-		return de.NewError("Initialize Failed: Invalid Single Mode Config")
 	}
-	return nil
-
+	return de.NewError("Initialize Failed: Invalid Single Mode Config")
 }
 
 func (sp *SessionPool) Close() {
+	sp.stopWatch()
 	switch sp.mode {
 	case SINGLE_MODE:
 		if sp.single != nil {
 			sp.single.Close()
 		}
-	case ROUND_ROBIN_MODE:
-		ss := sp.AllEndPoints()
+	case ROUND_ROBIN_MODE, PRIMARY_REPLICA_MODE, LEAST_CONN_MODE, LATENCY_MODE:
+		ss := sp.endPoints()
 		b := len(ss)
 		for i := 0; i < b; i++ {
 			ss[i].Close()
@@ -79,8 +165,8 @@ func (sp *SessionPool) Reconnect() {
 			sp.single.reconnect()
 		}
 	// Wait to verified
-	case ROUND_ROBIN_MODE:
-		ss := sp.AllEndPoints()
+	case ROUND_ROBIN_MODE, PRIMARY_REPLICA_MODE, LEAST_CONN_MODE, LATENCY_MODE:
+		ss := sp.endPoints()
 		b := len(ss)
 		for i := 0; i < b; i++ {
 			ss[i].reconnect()
@@ -89,117 +175,365 @@ func (sp *SessionPool) Reconnect() {
 
 }
 
+// AllEndPoints returns the valid sessions, the slice is never modified by the pool
 func (sp *SessionPool) AllEndPoints() []*Session {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
 	return sp.validEpList
 }
 
+// endPoints returns every session of the pool, workable or not
+func (sp *SessionPool) endPoints() []*Session {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return append([]*Session(nil), sp.epList...)
+}
+
 func (sp *SessionPool) AddEndPoint(s *Session) {
+	s.setPool(sp)
 	sp.mu.Lock()
 	sp.epList = append(sp.epList, s)
 	sp.mu.Unlock()
-	s.setPool(sp)
+	sp.emit(EVENT_ADDED, s.Name, "")
+	sp.CheckValidList()
+}
+
+// RemoveEndPoint takes the session of name out of the pool,
+// and closes it after its in-flight calls are done, or DrainTimeout passed.
+func (sp *SessionPool) RemoveEndPoint(name string) error {
+	var s *Session
+	ss := sp.endPoints()
+	b := len(ss)
+	for i := 0; i < b; i++ {
+		if ss[i].Name == name {
+			s = ss[i]
+			break
+		}
+	}
+	if s == nil || !sp.removeSession(s) {
+		return de.NewError("Remove EndPoint Failed: " + name + " Not Found")
+	}
+	return nil
+}
+
+// removeSession is RemoveEndPoint by the session, it returns false while s is not in the pool
+func (sp *SessionPool) removeSession(s *Session) bool {
+	sp.mu.Lock()
+	found := false
+	b := len(sp.epList)
+	for i := 0; i < b; i++ {
+		if sp.epList[i] == s {
+			sp.epList = append(sp.epList[:i:i], sp.epList[i+1:]...)
+			found = true
+			break
+		}
+	}
+	sp.mu.Unlock()
+	if !found {
+		return false
+	}
+	sp.emit(EVENT_REMOVED, s.Name, "")
+	sp.CheckValidList()
+	s.setPool(nil)
+	// The session is out of the list, its in-flight calls are drained without blocking the caller
+	go func() {
+		s.drain(DrainTimeout)
+		s.Close()
+	}()
+	return true
+}
+
+// ReplaceEndPoints makes the endpoints of the pool as infos, matched by Name.
+// The sessions of new names are connected, the ones of missing names are removed,
+// and the ones with changed connection parameters are reconnected as new sessions.
+// MaxConn, MaxIdle, HCInterval and Role of the other sessions are updated in place.
+func (sp *SessionPool) ReplaceEndPoints(infos []*DBInfo) error {
+	switch sp.mode {
+	case ROUND_ROBIN_MODE, PRIMARY_REPLICA_MODE, LEAST_CONN_MODE, LATENCY_MODE:
+	default:
+		return de.NewError("Replace EndPoints Failed: Not Supported in " + sp.mode)
+	}
+	if err := validateInfos(infos); err != nil {
+		return err
+	}
+	if sp.mode == PRIMARY_REPLICA_MODE {
+		primaries := 0
+		for _, info := range infos {
+			if info.Role == ROLE_PRIMARY {
+				primaries++
+			}
+		}
+		if primaries != 1 {
+			return de.NewError("Replace EndPoints Failed: PRIMARY_REPLICA_MODE needs exactly one primary")
+		}
+	}
+
+	current := map[string]*Session{}
+	for _, s := range sp.endPoints() {
+		current[s.Name] = s
+	}
+	var err error
+	wanted := map[string]bool{}
+	for _, info := range infos {
+		wanted[info.Name] = true
+		s, ok := current[info.Name]
+		if ok {
+			if cur := s.info(); sameConnection(&cur, info) {
+				s.updateInfo(info)
+				continue
+			}
+		}
+		ns, connErr := newSession(info)
+		if connErr != nil && err == nil {
+			err = connErr
+		}
+		// The new session serves before the old one drains
+		sp.AddEndPoint(ns)
+		if ok {
+			sp.removeSession(s)
+		}
+	}
+	for name, s := range current {
+		if !wanted[name] {
+			sp.removeSession(s)
+		}
+	}
+	sp.CheckValidList()
+	return err
 }
 
 func (sp *SessionPool) CheckValidList() {
 	sp.mu.Lock()
-	defer sp.mu.Unlock()
-	sp.validEpList = sp.validEpList[:0]
+	// A new slice, the former one may still be held by the callers of AllEndPoints
+	sp.validEpList = make([]*Session, 0, len(sp.epList))
+	if sp.mode == PRIMARY_REPLICA_MODE {
+		sp.primary = nil
+	}
 	b := len(sp.epList)
 	for i := 0; i < b; i++ {
-		if sp.epList[i].Workable() {
+		// The primary never serves as a replica in PRIMARY_REPLICA_MODE
+		if sp.mode == PRIMARY_REPLICA_MODE && sp.epList[i].info().Role == ROLE_PRIMARY {
+			sp.primary = sp.epList[i]
+			continue
+		}
+		// A lagging replica is left out until it catches up
+		if sp.epList[i].Workable() && !sp.epList[i].Lagging() {
 			sp.validEpList = append(sp.validEpList, sp.epList[i])
 		}
 	}
+	sp.checkWeighted()
+	wasAvailable := sp.available
+	switch sp.mode {
+	case SINGLE_MODE:
+		sp.available = sp.single != nil && sp.single.Workable()
+	case PRIMARY_REPLICA_MODE:
+		sp.available = len(sp.validEpList) > 0 || (sp.primary != nil && sp.primary.Workable())
+	default:
+		sp.available = len(sp.validEpList) > 0
+	}
+	available := sp.available
+	sp.mu.Unlock()
+	if wasAvailable && !available {
+		sp.emit(EVENT_UNAVAILABLE, "", "no workable endpoint")
+	}
 }
 
 func (sp *SessionPool) RREndPoint() (*Session, de.AsDroiError) {
 	sp.mu.RLock()
 	defer sp.mu.RUnlock()
+	return sp.rrEndPoint()
+}
+
+// rrEndPoint is RREndPoint, the caller holds sp.mu
+func (sp *SessionPool) rrEndPoint() (*Session, de.AsDroiError) {
 	l := len(sp.validEpList)
-	for i := 0; i < l; i++ {
-		fmt.Sprintf("%#v", sp.validEpList[i])
-	}
 	if l == 0 {
-		return nil, de.NewTraceWithMsg(rdb.ErrDatabaseUnavailable,"")
+		return nil, de.NewTraceWithMsg(rdb.ErrDatabaseUnavailable, "")
 	}
 	if l == 1 {
 		return sp.validEpList[0], nil
 	}
+	if sp.weighted {
+		return sp.swrrEndPoint(), nil
+	}
 	p := atomic.AddUint64(&sp.pos, 1) - 1
 
 	return sp.validEpList[p%uint64(l)], nil
 }
 
+// primaryEndPoint is the primary while its breaker admits the call, the caller holds sp.mu
+func (sp *SessionPool) primaryEndPoint() (*Session, de.AsDroiError) {
+	if sp.primary == nil || !sp.primary.allow() {
+		return nil, de.NewTraceWithMsg(rdb.ErrDatabaseUnavailable, "")
+	}
+	return sp.primary, nil
+}
+
+// admit checks the picked session by its breaker,
+// a half-open one out of probes gives the call to another valid session, the caller holds sp.mu
+func (sp *SessionPool) admit(ret *Session, err de.AsDroiError) (*Session, de.AsDroiError) {
+	if err != nil || ret.allow() {
+		return ret, err
+	}
+	b := len(sp.validEpList)
+	for i := 0; i < b; i++ {
+		if sp.validEpList[i] != ret && sp.validEpList[i].allow() {
+			return sp.validEpList[i], nil
+		}
+	}
+	return nil, de.NewTraceWithMsg(rdb.ErrDatabaseUnavailable, "")
+}
+
+// getSession picks the session for a call, the caller must release it after the call
 func (sp *SessionPool) getSession(ctx droictx.Context) (ret *Session, err de.AsDroiError) {
 	if sp.mode == SINGLE_MODE {
-		if sp.single.Workable() {
+		if sp.single.allow() {
+			sp.single.acquire()
 			sp.single.setCtx(ctx)
 			return sp.single, nil
 		} else {
-			return nil, de.NewTraceWithMsg(rdb.ErrDatabaseUnavailable,"")
+			return nil, de.NewTraceWithMsg(rdb.ErrDatabaseUnavailable, "")
 		}
 
 	}
-	ret, err = sp.RREndPoint()
+	// Acquiring under sp.mu, so RemoveEndPoint never misses a call to drain
+	sp.mu.RLock()
+	switch sp.mode {
+	case PRIMARY_REPLICA_MODE:
+		ret, err = sp.primaryEndPoint()
+	case LEAST_CONN_MODE:
+		ret, err = sp.admit(sp.leastConnEndPoint())
+	case LATENCY_MODE:
+		ret, err = sp.admit(sp.latencyEndPoint())
+	default:
+		ret, err = sp.admit(sp.rrEndPoint())
+	}
+	if err == nil {
+		ret.acquire()
+	}
+	sp.mu.RUnlock()
+	if err == nil {
+		ret.setCtx(ctx)
+	}
+	return
+}
+
+// getReadSession is getSession for read only statements.
+// In PRIMARY_REPLICA_MODE it picks a workable replica, and falls back to the primary.
+func (sp *SessionPool) getReadSession(ctx droictx.Context) (ret *Session, err de.AsDroiError) {
+	if sp.mode != PRIMARY_REPLICA_MODE {
+		return sp.getSession(ctx)
+	}
+	sp.mu.RLock()
+	ret, err = sp.admit(sp.rrEndPoint())
+	if err != nil {
+		ret, err = sp.primaryEndPoint()
+	}
+	if err == nil {
+		ret.acquire()
+	}
+	sp.mu.RUnlock()
 	if err == nil {
 		ret.setCtx(ctx)
 	}
 	return
 }
 
+// getTxSession lets read only transactions run on a replica, except the serializable ones
+func (sp *SessionPool) getTxSession(ctx droictx.Context, opts []TxOptions) (*Session, de.AsDroiError) {
+	if o := txOption(opts); o != nil && o.onReplica() {
+		return sp.getReadSession(ctx)
+	}
+	return sp.getSession(ctx)
+}
+
 func (sp *SessionPool) OneRecord(ctx droictx.Context, ret interface{}, whereClause string, args ...interface{}) (err de.AsDroiError) {
-	s, err := sp.getSession(ctx)
+	s, err := sp.getReadSession(ctx)
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.OneRecord(ctx, ret, whereClause, args...)
 }
 
 func (sp *SessionPool) Query(ctx droictx.Context, where, order string, limit, offset int, ret interface{}) (err de.AsDroiError) {
-	s, err := sp.getSession(ctx)
+	s, err := sp.getReadSession(ctx)
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.Query(ctx, where, order, limit, offset, ret)
 }
 
 func (sp *SessionPool) TableQuery(ctx droictx.Context, table, where, order string, limit, offset int, ret interface{}) (err de.AsDroiError) {
-	s, err := sp.getSession(ctx)
+	s, err := sp.getReadSession(ctx)
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.TableQuery(ctx, table, where, order, limit, offset, ret)
 }
 
 func (sp *SessionPool) SQLQuery(ctx droictx.Context, ret interface{}, querySql string, args ...interface{}) (err de.AsDroiError) {
-	s, err := sp.getSession(ctx)
+	s, err := sp.getReadSession(ctx)
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.SQLQuery(ctx, ret, querySql, args...)
 }
 
 func (sp *SessionPool) WhereQuery(ctx droictx.Context, where interface{}, order string, limit, offset int, ret interface{}) (err de.AsDroiError) {
-	s, err := sp.getSession(ctx)
+	s, err := sp.getReadSession(ctx)
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.WhereQuery(ctx, where, order, limit, offset, ret)
 }
 
 func (sp *SessionPool) Count(ctx droictx.Context, where string, model interface{}, ret *int) (err de.AsDroiError) {
-	s, err := sp.getSession(ctx)
+	s, err := sp.getReadSession(ctx)
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.Count(ctx, where, model, ret)
 }
 
+func (sp *SessionPool) CriteriaQuery(ctx droictx.Context, ret interface{}, order string, limit, offset int, criteria string, args ...interface{}) (err de.AsDroiError) {
+	s, err := sp.getReadSession(ctx)
+	if err != nil {
+		return
+	}
+	defer s.release()
+	return s.CriteriaQuery(ctx, ret, order, limit, offset, criteria, args...)
+}
+
+func (sp *SessionPool) CriteriaTableQuery(ctx droictx.Context, ret interface{}, table, order string, limit, offset int, criteria string, args ...interface{}) (err de.AsDroiError) {
+	s, err := sp.getReadSession(ctx)
+	if err != nil {
+		return
+	}
+	defer s.release()
+	return s.CriteriaTableQuery(ctx, ret, table, order, limit, offset, criteria, args...)
+}
+
+func (sp *SessionPool) CriteriaCount(ctx droictx.Context, model interface{}, ret *int, criteria string, args ...interface{}) (err de.AsDroiError) {
+	s, err := sp.getReadSession(ctx)
+	if err != nil {
+		return
+	}
+	defer s.release()
+	return s.CriteriaCount(ctx, model, ret, criteria, args...)
+}
+
 func (sp *SessionPool) Insert(ctx droictx.Context, ret interface{}) (err de.AsDroiError) {
 	s, err := sp.getSession(ctx)
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.Insert(ctx, ret)
 }
 
@@ -208,6 +542,7 @@ func (sp *SessionPool) OmitInsert(ctx droictx.Context, ret interface{}, omit str
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.OmitInsert(ctx, ret, omit)
 }
 
@@ -216,6 +551,7 @@ func (sp *SessionPool) Update(ctx droictx.Context, ret interface{}, fields map[s
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.Update(ctx, ret, fields)
 }
 
@@ -224,15 +560,17 @@ func (sp *SessionPool) UpdateNonBlank(ctx droictx.Context, ret interface{}) (err
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.UpdateNonBlank(ctx, ret)
 }
 
-func (sp *SessionPool) CriteriaUpdate(ctx droictx.Context, ret interface{}, fields map[string]interface{}, criteria string, args ...interface{}) (err de.AsDroiError)  {
+func (sp *SessionPool) CriteriaUpdate(ctx droictx.Context, ret interface{}, fields map[string]interface{}, criteria string, args ...interface{}) (err de.AsDroiError) {
 	s, err := sp.getSession(ctx)
 	if err != nil {
-		return 
+		return
 	}
-	return s.CriteriaUpdate(ctx, ret, fields, criteria, args ...)
+	defer s.release()
+	return s.CriteriaUpdate(ctx, ret, fields, criteria, args...)
 }
 
 func (sp *SessionPool) Delete(ctx droictx.Context, ret interface{}) (err de.AsDroiError) {
@@ -240,23 +578,26 @@ func (sp *SessionPool) Delete(ctx droictx.Context, ret interface{}) (err de.AsDr
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.Delete(ctx, ret)
 }
 
-func (sp *SessionPool) CriteriaDelete(ctx droictx.Context, ret interface{}, criteria string, args ...interface{}) (err de.AsDroiError)  {
+func (sp *SessionPool) CriteriaDelete(ctx droictx.Context, ret interface{}, criteria string, args ...interface{}) (err de.AsDroiError) {
 	s, err := sp.getSession(ctx)
 	if err != nil {
 		return
 	}
-	return s.CriteriaDelete(ctx, ret, criteria, args ...)
+	defer s.release()
+	return s.CriteriaDelete(ctx, ret, criteria, args...)
 }
 
 func (sp *SessionPool) Join(ctx droictx.Context, ret interface{}, table, fields, join, order, criteria string, args ...interface{}) (err de.AsDroiError) {
-	s, err := sp.getSession(ctx)
+	s, err := sp.getReadSession(ctx)
 	if err != nil {
 		return
 	}
-	return s.Join(ctx, ret, table, fields, join, order, criteria, args ...)
+	defer s.release()
+	return s.Join(ctx, ret, table, fields, join, order, criteria, args...)
 }
 
 func (sp *SessionPool) Execute(ctx droictx.Context, sql string, values ...interface{}) (err de.AsDroiError) {
@@ -264,15 +605,42 @@ func (sp *SessionPool) Execute(ctx droictx.Context, sql string, values ...interf
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.Execute(ctx, sql, values...)
 }
 
-func (sp *SessionPool) Transaction(ctx droictx.Context, sqls []string) (err de.AsDroiError) {
-	s, err := sp.getSession(ctx)
+func (sp *SessionPool) Transaction(ctx droictx.Context, sqls []string, opts ...TxOptions) (err de.AsDroiError) {
+	s, err := sp.getTxSession(ctx, opts)
+	if err != nil {
+		return
+	}
+	defer s.release()
+	return s.Transaction(ctx, sqls, opts...)
+}
+
+// WithTx is Session.WithTx, the nested calls stay in the transaction without taking another session
+func (sp *SessionPool) WithTx(ctx droictx.Context, fn func(tx *Tx) error, opts ...TxOptions) (err de.AsDroiError) {
+	if t := openTx(ctx, sp); t != nil {
+		return t.WithTx(ctx, fn, opts...)
+	}
+	s, err := sp.getTxSession(ctx, opts)
 	if err != nil {
 		return
 	}
-	return s.Transaction(ctx, sqls)
+	defer s.release()
+	return s.WithTx(ctx, fn, opts...)
+}
+
+func (sp *SessionPool) WithTxRetry(ctx droictx.Context, policy TxRetryPolicy, fn func(tx *Tx) error, opts ...TxOptions) (err de.AsDroiError) {
+	if t := openTx(ctx, sp); t != nil {
+		return t.WithTx(ctx, fn, opts...)
+	}
+	s, err := sp.getTxSession(ctx, opts)
+	if err != nil {
+		return
+	}
+	defer s.release()
+	return s.WithTxRetry(ctx, policy, fn, opts...)
 }
 
 func (sp *SessionPool) RowScan(ctx droictx.Context, sql string, ptrs ...interface{}) (err de.AsDroiError) {
@@ -280,15 +648,37 @@ func (sp *SessionPool) RowScan(ctx droictx.Context, sql string, ptrs ...interfac
 	if err != nil {
 		return
 	}
+	defer s.release()
 	return s.RowScan(ctx, sql, ptrs...)
 }
 
-func (sp *SessionPool) Rows(ctx droictx.Context, sql string) (rows *sql.Rows, err de.AsDroiError) {
+func (sp *SessionPool) RowScanArgs(ctx droictx.Context, sql string, args []interface{}, ptrs ...interface{}) (err de.AsDroiError) {
+	s, err := sp.getSession(ctx)
+	if err != nil {
+		return
+	}
+	defer s.release()
+	return s.RowScanArgs(ctx, sql, args, ptrs...)
+}
+
+// Rows returns the rows of sql, the caller must Close them.
+// A removed session drains its open rows by the connections in use, see Session.drain.
+func (sp *SessionPool) Rows(ctx droictx.Context, sql string, args ...interface{}) (rows *sql.Rows, err de.AsDroiError) {
+	s, err := sp.getSession(ctx)
+	if err != nil {
+		return
+	}
+	defer s.release()
+	return s.Rows(ctx, sql, args...)
+}
+
+func (sp *SessionPool) EachRow(ctx droictx.Context, querySql string, fn func(*sql.Rows) error, args ...interface{}) (err de.AsDroiError) {
 	s, err := sp.getSession(ctx)
 	if err != nil {
 		return
 	}
-	return s.Rows(ctx, sql)
+	defer s.release()
+	return s.EachRow(ctx, querySql, fn, args...)
 }
 
 func (sp *SessionPool) GetGORM(ctx droictx.Context) (ret *gorm.DB, err de.AsDroiError) {
@@ -296,11 +686,12 @@ func (sp *SessionPool) GetGORM(ctx droictx.Context) (ret *gorm.DB, err de.AsDroi
 	if err != nil {
 		return
 	}
-	ret = s.Conn.New()
+	defer s.release()
+	ret = s.conn().New()
 	return
 }
 
-//LogMode : For enabling log
+// LogMode : For enabling log
 func (sp *SessionPool) LogMode(ctx droictx.Context, enable bool) (err de.AsDroiError) {
 	// FIXME
 	// It should be for all session
@@ -308,6 +699,7 @@ func (sp *SessionPool) LogMode(ctx droictx.Context, enable bool) (err de.AsDroiE
 	if err != nil {
 		return
 	}
-	s.Conn.LogMode(enable)
+	defer s.release()
+	s.setLogMode(enable)
 	return
 }
@@ -0,0 +1,126 @@
+package postgres
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// unreachableInfo connects a port nothing listens on, and gives up at once
+func unreachableInfo(name string) *DBInfo {
+	return &DBInfo{
+		Name:     name,
+		Host:     "127.0.0.1",
+		Port:     1,
+		Database: "test",
+		User:     "test",
+		MaxConn:  1,
+		MaxIdle:  1,
+		Retry:    RetryPolicy{MaxAttempts: 1, FailFast: true, ConnectTimeout: time.Second},
+	}
+}
+
+func TestInitializeNoEndPointConnected(t *testing.T) {
+	modes := []string{ROUND_ROBIN_MODE, LEAST_CONN_MODE, LATENCY_MODE, PRIMARY_REPLICA_MODE}
+	for _, mode := range modes {
+		infos := []*DBInfo{unreachableInfo("a"), unreachableInfo("b")}
+		infos[0].Role = ROLE_PRIMARY
+		infos[1].Role = ROLE_REPLICA
+		sp := &SessionPool{}
+		err := sp.Initialize(infos, mode)
+		if err == nil {
+			t.Errorf("%s: Initialize succeeds while no endpoint connected", mode)
+		}
+		if n := len(sp.endPoints()); n != 2 {
+			t.Errorf("%s: %d endpoints, want 2", mode, n)
+		}
+		for _, s := range sp.endPoints() {
+			if s.Workable() {
+				t.Errorf("%s: %s is workable", mode, s.Name)
+			}
+		}
+		if n := len(sp.AllEndPoints()); n != 0 {
+			t.Errorf("%s: %d valid endpoints, want 0", mode, n)
+		}
+		sp.Close()
+	}
+}
+
+func TestRemoveEndPointDoesNotWait(t *testing.T) {
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	s := &Session{DBInfo: *unreachableInfo("a"), breaker: newBreaker(BreakerConfig{}.withDefaults(0))}
+	sp.AddEndPoint(s)
+	s.acquire()
+	start := time.Now()
+	if err := sp.RemoveEndPoint("a"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("RemoveEndPoint waits %v for the in-flight call", d)
+	}
+	if n := len(sp.endPoints()); n != 0 {
+		t.Errorf("%d endpoints, want 0", n)
+	}
+	s.release()
+}
+
+// workableSession is a session which never connects, with its breaker closed
+func workableSession(name, role string) *Session {
+	s := &Session{DBInfo: DBInfo{Name: name, Role: role}, Type: DB_TYPE_POSTGRES}
+	s.breaker = newBreaker(BreakerConfig{}.withDefaults(0))
+	s.setHealth(&s.DBInfo)
+	return s
+}
+
+func TestGetTxSessionRouting(t *testing.T) {
+	sp := &SessionPool{mode: PRIMARY_REPLICA_MODE}
+	primary := workableSession("primary", ROLE_PRIMARY)
+	replica := workableSession("replica", ROLE_REPLICA)
+	sp.AddEndPoint(primary)
+	sp.AddEndPoint(replica)
+
+	route := func(opts ...TxOptions) string {
+		s, err := sp.getTxSession(newTestCtx(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.release()
+		return s.Name
+	}
+	if got := route(); got != "primary" {
+		t.Errorf("default: %s, want primary", got)
+	}
+	if got := route(TxOptions{ReadOnly: true}); got != "replica" {
+		t.Errorf("read only: %s, want replica", got)
+	}
+	if got := route(TxOptions{ReadOnly: true, Isolation: sql.LevelRepeatableRead}); got != "replica" {
+		t.Errorf("read only repeatable read: %s, want replica", got)
+	}
+	// A hot standby rejects serializable transactions
+	if got := route(TxOptions{ReadOnly: true, Isolation: sql.LevelSerializable, Deferrable: true}); got != "primary" {
+		t.Errorf("read only serializable: %s, want primary", got)
+	}
+}
+
+func TestAddEndPointsConcurrently(t *testing.T) {
+	infos := make([]*DBInfo, 4)
+	for i := range infos {
+		infos[i] = unreachableInfo(string(rune('a' + i)))
+		infos[i].Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: 200 * time.Millisecond, MaxBackoff: 200 * time.Millisecond}
+	}
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	defer sp.Close()
+	start := time.Now()
+	if err := sp.addEndPoints(infos); err == nil {
+		t.Error("addEndPoints succeeds while no endpoint connected")
+	}
+	// One after another, it would take 4 backoffs
+	if d := time.Since(start); d > 600*time.Millisecond {
+		t.Errorf("addEndPoints takes %v for 4 hosts down", d)
+	}
+	for i, s := range sp.endPoints() {
+		if s.Name != infos[i].Name {
+			t.Errorf("endpoint %d is %s, want %s", i, s.Name, infos[i].Name)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package postgres
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSessionUpdateRace runs the health checking, the breaker and updateInfo together, for go test -race
+func TestSessionUpdateRace(t *testing.T) {
+	info := unreachableInfo("a")
+	info.Breaker = BreakerConfig{OpenTimeout: 5 * time.Millisecond}
+	s := &Session{DBInfo: *info, Type: DB_TYPE_POSTGRES}
+	s.breaker = newBreaker(info.Breaker.withDefaults(info.HCInterval))
+	s.setHealth(info)
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	sp.AddEndPoint(s)
+	s.startHealthCheck()
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	run := func(fn func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				fn(i)
+			}
+		}()
+	}
+	run(func(i int) {
+		next := *info
+		next.MaxConn = i + 1
+		next.Role = ROLE_REPLICA
+		next.Retry.MaxAttempts = i + 1
+		next.HCInterval = time.Duration(i+1) * time.Millisecond
+		s.updateInfo(&next)
+	})
+	run(func(int) {
+		s.unWorkable()
+		time.Sleep(time.Millisecond)
+	})
+	run(func(int) {
+		s.Status()
+		sp.Status()
+		sp.CheckValidList()
+	})
+	run(func(i int) {
+		if i%10 == 0 {
+			s.setPool(sp)
+		}
+		s.conninfo(info.Host, info.Port, info.User, "", info.Database)
+	})
+	wg.Wait()
+}
+
+// TestSetHealthInterval checks the periodic checking runs only while there is something to check
+func TestSetHealthInterval(t *testing.T) {
+	interval := func(info DBInfo) time.Duration {
+		s := &Session{}
+		s.setHealth(&info)
+		return s.healthConfig().interval
+	}
+	if got := interval(DBInfo{HCInterval: time.Second}); got != 0 {
+		t.Errorf("HCInterval alone starts a ticker of %v", got)
+	}
+	if got := interval(DBInfo{HealthQuery: "SELECT 1", HCInterval: time.Second}); got != time.Second {
+		t.Errorf("HealthQuery: interval %v, want HCInterval", got)
+	}
+	if got := interval(DBInfo{HealthQuery: "SELECT 1"}); got != DEFAULT_HC_INTERVAL {
+		t.Errorf("HealthQuery without HCInterval: interval %v, want DEFAULT_HC_INTERVAL", got)
+	}
+	if got := interval(DBInfo{MaxReplicationLag: time.Second, HCInterval: 2 * time.Second}); got != 2*time.Second {
+		t.Errorf("MaxReplicationLag: interval %v, want HCInterval", got)
+	}
+}
+
+// TestUnreachableHost checks the health checking ticks while the session never connected
+func TestUnreachableHost(t *testing.T) {
+	info := unreachableInfo("a")
+	info.HCInterval = 10 * time.Millisecond
+	info.MaxReplicationLag = time.Second
+	info.HealthQuery = "SELECT 1"
+	info.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: 30 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	info.Breaker = BreakerConfig{OpenTimeout: 10 * time.Millisecond}
+	s, err := newSession(info)
+	if err == nil {
+		t.Fatal("newSession connects an unreachable host")
+	}
+	defer s.Close()
+	time.Sleep(100 * time.Millisecond)
+	if s.Workable() {
+		t.Error("the unreachable session is workable")
+	}
+	if s.conn() != nil {
+		t.Error("the unreachable session has a connection")
+	}
+}
+
+// TestReconnectFailedKeepsConn checks a failed reconnect leaves the session an open handle to probe with
+func TestReconnectFailedKeepsConn(t *testing.T) {
+	s := unreachableSession(t)
+	info := unreachableInfo("a")
+	s.DBInfo, s.Type = *info, DB_TYPE_POSTGRES
+	s.breaker = newBreaker(info.Breaker.withDefaults(info.HCInterval))
+	s.setHealth(info)
+	old := s.conn()
+	defer s.Close()
+
+	if s.reconnect() {
+		t.Fatal("reconnect to an unreachable host succeeds")
+	}
+	if s.conn() != old {
+		t.Fatal("a failed reconnect replaces Conn")
+	}
+	if err := old.DB().Ping(); err != nil && err.Error() == "sql: database is closed" {
+		t.Error("a failed reconnect closes the Conn it keeps")
+	}
+}
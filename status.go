@@ -0,0 +1,125 @@
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// EndPointStatus is the health of a session
+type EndPointStatus struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Role     string `json:"role,omitempty"`
+	Workable bool   `json:"workable"`
+	Breaker  string `json:"breaker"`
+	Lagging  bool   `json:"lagging"`
+	// ReplicationLag is in milliseconds
+	ReplicationLag int64 `json:"replication_lag"`
+	// LastCheck is zero while the session was never health checked
+	LastCheck           time.Time   `json:"last_check"`
+	LastError           string      `json:"last_error,omitempty"`
+	ConsecutiveFailures int64       `json:"consecutive_failures"`
+	InFlight            int64       `json:"in_flight"`
+	Stats               sql.DBStats `json:"stats"`
+}
+
+// PoolStatus is the health of a pool, Available is false while no session is workable
+type PoolStatus struct {
+	Mode      string           `json:"mode"`
+	Available bool             `json:"available"`
+	EndPoints []EndPointStatus `json:"endpoints"`
+}
+
+// checked records the result of a health checking
+func (s *Session) checked(err error) {
+	atomic.StoreInt64(&s.lastCheck, time.Now().UnixNano())
+	if err != nil {
+		s.failed(err)
+	} else {
+		atomic.StoreInt64(&s.failures, 0)
+	}
+}
+
+// failed counts a consecutive failure of the calls and the health checking
+func (s *Session) failed(err error) {
+	atomic.AddInt64(&s.failures, 1)
+	s.lastErr.Store(err.Error())
+}
+
+// Status is the health of the session
+func (s *Session) Status() EndPointStatus {
+	dbi := s.info()
+	st := EndPointStatus{
+		Name:                dbi.Name,
+		Host:                dbi.Host,
+		Port:                dbi.Port,
+		Role:                dbi.Role,
+		Workable:            s.Workable(),
+		Breaker:             s.BreakerState(),
+		Lagging:             s.Lagging(),
+		ReplicationLag:      millis(s.ReplicationLag()),
+		ConsecutiveFailures: atomic.LoadInt64(&s.failures),
+		InFlight:            s.InFlight(),
+	}
+	if t := atomic.LoadInt64(&s.lastCheck); t > 0 {
+		st.LastCheck = time.Unix(0, t)
+	}
+	if e, ok := s.lastErr.Load().(string); ok {
+		st.LastError = e
+	}
+	if c := s.conn(); c != nil {
+		st.Stats = c.DB().Stats()
+	}
+	return st
+}
+
+// Status is the health of every session of the pool, workable or not
+func (sp *SessionPool) Status() PoolStatus {
+	ss := sp.endPoints()
+	if sp.mode == SINGLE_MODE && sp.single != nil {
+		ss = []*Session{sp.single}
+	}
+	ps := PoolStatus{Mode: sp.mode, EndPoints: make([]EndPointStatus, 0, len(ss))}
+	b := len(ss)
+	for i := 0; i < b; i++ {
+		ps.EndPoints = append(ps.EndPoints, ss[i].Status())
+	}
+	ps.Available = ps.available()
+	return ps
+}
+
+// available is decided as CheckValidList does, a lagging replica serves nothing,
+// while the primary and the single session serve whenever they are workable
+func (ps *PoolStatus) available() bool {
+	b := len(ps.EndPoints)
+	for i := 0; i < b; i++ {
+		st := ps.EndPoints[i]
+		if !st.Workable {
+			continue
+		}
+		if !st.Lagging || ps.Mode == SINGLE_MODE || (ps.Mode == PRIMARY_REPLICA_MODE && st.Role == ROLE_PRIMARY) {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusHandler serves Status in JSON for the readiness and liveness probes,
+// with 503 while no session is workable
+func (sp *SessionPool) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, sp.Status())
+	})
+}
+
+func writeStatus(w http.ResponseWriter, ps PoolStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ps.Available {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ps)
+}
@@ -0,0 +1,63 @@
+package postgres
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// TestStatusAvailableAsValidList checks Status and CheckValidList agree on a pool whose only workable replica lags
+func TestStatusAvailableAsValidList(t *testing.T) {
+	for _, mode := range []string{ROUND_ROBIN_MODE, PRIMARY_REPLICA_MODE} {
+		sp := &SessionPool{mode: mode}
+		primary := workableSession("primary", ROLE_PRIMARY)
+		replica := workableSession("replica", ROLE_REPLICA)
+		sp.AddEndPoint(primary)
+		sp.AddEndPoint(replica)
+		primary.unWorkable()
+		atomic.StoreInt32(&replica.lagging, 1)
+		sp.CheckValidList()
+
+		if got := sp.Status().Available; got != sp.available || got {
+			t.Errorf("%s: Status available %v, CheckValidList %v, want both false", mode, got, sp.available)
+		}
+	}
+
+	// The primary serves in PRIMARY_REPLICA_MODE though the replica lags
+	sp := &SessionPool{mode: PRIMARY_REPLICA_MODE}
+	sp.AddEndPoint(workableSession("primary", ROLE_PRIMARY))
+	replica := workableSession("replica", ROLE_REPLICA)
+	sp.AddEndPoint(replica)
+	atomic.StoreInt32(&replica.lagging, 1)
+	sp.CheckValidList()
+	if !sp.Status().Available || !sp.available {
+		t.Errorf("primary workable: Status available %v, CheckValidList %v, want both true", sp.Status().Available, sp.available)
+	}
+}
+
+func TestStatusHandlerFollowsDefault(t *testing.T) {
+	Unregister(DEFAULT_POOL)
+	defer Unregister(DEFAULT_POOL)
+	// Made before Initialize
+	h := StatusHandler()
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+		return rec.Code
+	}
+	if code := serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("no default pool: %d, want 503", code)
+	}
+
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	sp.AddEndPoint(workableSession("a", ""))
+	sp.CheckValidList()
+	poolsMu.Lock()
+	pools[DEFAULT_POOL] = sp
+	stdPool = sp
+	poolsMu.Unlock()
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("workable default pool: %d, want 200", code)
+	}
+}
@@ -0,0 +1,115 @@
+package postgres
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"io/ioutil"
+	"net"
+	"time"
+
+	de "github.com/DroiTaipei/droipkg"
+	"github.com/lib/pq"
+)
+
+const (
+	SSL_DISABLE     = "disable"
+	SSL_REQUIRE     = "require"
+	SSL_VERIFY_CA   = "verify-ca"
+	SSL_VERIFY_FULL = "verify-full"
+)
+
+var sslModes = map[string]bool{
+	SSL_DISABLE:     true,
+	SSL_REQUIRE:     true,
+	SSL_VERIFY_CA:   true,
+	SSL_VERIFY_FULL: true,
+}
+
+// sslMode is SSLMode, disable by default
+func (info *DBInfo) sslMode() string {
+	if len(info.SSLMode) == 0 {
+		return SSL_DISABLE
+	}
+	return info.SSLMode
+}
+
+// Validate checks the TLS settings and the weight, so a bad config fails before any connecting attempt
+func (info *DBInfo) Validate() error {
+	if info.Weight < 0 {
+		return de.NewError(info.Name + ": Negative Weight")
+	}
+	if info.MaxReplicationLag < 0 {
+		return de.NewError(info.Name + ": Negative MaxReplicationLag")
+	}
+	mode := info.sslMode()
+	if !sslModes[mode] {
+		return de.NewError(info.Name + ": Invalid sslmode " + mode)
+	}
+	if mode == SSL_DISABLE {
+		if len(info.SSLRootCert) > 0 || len(info.SSLCert) > 0 || len(info.SSLKey) > 0 || len(info.SSLServerName) > 0 {
+			return de.NewError(info.Name + ": TLS settings need sslmode other than disable")
+		}
+		return nil
+	}
+	if len(info.SSLRootCert) > 0 {
+		pem, err := ioutil.ReadFile(info.SSLRootCert)
+		if err != nil {
+			return de.NewError(info.Name + ": Invalid sslrootcert, " + err.Error())
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return de.NewError(info.Name + ": Invalid sslrootcert, no certificate found in " + info.SSLRootCert)
+		}
+	}
+	if len(info.SSLCert) > 0 || len(info.SSLKey) > 0 {
+		if len(info.SSLCert) == 0 || len(info.SSLKey) == 0 {
+			return de.NewError(info.Name + ": sslcert and sslkey must be set together")
+		}
+		if _, err := tls.LoadX509KeyPair(info.SSLCert, info.SSLKey); err != nil {
+			return de.NewError(info.Name + ": Invalid sslcert or sslkey, " + err.Error())
+		}
+	}
+	if len(info.SSLServerName) > 0 && mode != SSL_VERIFY_FULL {
+		return de.NewError(info.Name + ": sslservername needs sslmode verify-full")
+	}
+	return nil
+}
+
+func validateInfos(infos []*DBInfo) error {
+	b := len(infos)
+	for i := 0; i < b; i++ {
+		if err := infos[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addrDialer dials addr whatever the address lib/pq asks,
+// so the host of the conninfo could be the TLS server name.
+type addrDialer struct {
+	addr string
+}
+
+func (d addrDialer) Dial(network, address string) (net.Conn, error) {
+	return net.Dial(network, d.addr)
+}
+
+func (d addrDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(network, d.addr, timeout)
+}
+
+// dialConnector opens lib/pq connections through an addrDialer
+type dialConnector struct {
+	conninfo string
+	dialer   addrDialer
+}
+
+func (c *dialConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return pq.DialOpen(c.dialer, c.conninfo)
+}
+
+func (c *dialConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
@@ -0,0 +1,429 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DroiTaipei/droictx"
+	de "github.com/DroiTaipei/droipkg"
+	"github.com/DroiTaipei/droipkg/rdb"
+	"github.com/devopstaku/gorm"
+)
+
+// TxOptions sets the characteristics of a transaction
+type TxOptions struct {
+	// Isolation is one of sql.LevelDefault, sql.LevelReadCommitted,
+	// sql.LevelRepeatableRead and sql.LevelSerializable
+	Isolation  sql.IsolationLevel
+	ReadOnly   bool
+	Deferrable bool
+}
+
+var isolationSQL = map[sql.IsolationLevel]string{
+	sql.LevelReadUncommitted: "READ UNCOMMITTED",
+	sql.LevelReadCommitted:   "READ COMMITTED",
+	sql.LevelRepeatableRead:  "REPEATABLE READ",
+	sql.LevelSerializable:    "SERIALIZABLE",
+}
+
+// txOption picks the first options, for the variadic opts arguments
+func txOption(opts []TxOptions) *TxOptions {
+	if len(opts) == 0 {
+		return nil
+	}
+	return &opts[0]
+}
+
+// onReplica tells whether a replica could run the transaction,
+// a hot standby rejects the serializable ones
+func (o *TxOptions) onReplica() bool {
+	return o.ReadOnly && o.Isolation != sql.LevelSerializable
+}
+
+// setTransaction is the SET TRANSACTION statement of o, empty while o keeps the defaults
+func (o *TxOptions) setTransaction() (string, error) {
+	var modes []string
+	if o.Isolation != sql.LevelDefault {
+		level, ok := isolationSQL[o.Isolation]
+		if !ok {
+			return "", de.NewTraceWithMsg(rdb.ErrProcessFailed, "Unsupported Isolation Level: "+o.Isolation.String())
+		}
+		modes = append(modes, "ISOLATION LEVEL "+level)
+	}
+	if o.ReadOnly {
+		modes = append(modes, "READ ONLY")
+	}
+	if o.Deferrable {
+		modes = append(modes, "DEFERRABLE")
+	}
+	if len(modes) == 0 {
+		return "", nil
+	}
+	return "SET TRANSACTION " + strings.Join(modes, ", "), nil
+}
+
+// Tx is an open transaction of a Session, it offers the same methods as Session
+type Tx struct {
+	Conn *gorm.DB
+	s    *Session
+	// retryable is set while any statement hit a serialization failure or deadlock
+	retryable bool
+	// opts are the options the transaction began with
+	opts       TxOptions
+	savepoints int
+}
+
+// openTxs are the transactions running their fn by txKey,
+// so WithTx called with the same ctx inside fn nests as Tx.WithTx
+var openTxs sync.Map
+
+// txKey is the droictx.Context under any stdCtx, and the pool, or the session without pool, of a transaction
+type txKey struct {
+	ctx   droictx.Context
+	owner interface{}
+}
+
+func newTxKey(ctx droictx.Context, owner interface{}) (txKey, bool) {
+	if sc, ok := ctx.(*stdCtx); ok {
+		ctx = sc.Context
+	}
+	// The contexts which can not be a map key never nest
+	if ctx == nil || !reflect.TypeOf(ctx).Comparable() {
+		return txKey{}, false
+	}
+	return txKey{ctx: ctx, owner: owner}, true
+}
+
+// openTx is the transaction running its fn with ctx on owner, nil if there is none
+func openTx(ctx droictx.Context, owner interface{}) *Tx {
+	if k, ok := newTxKey(ctx, owner); ok {
+		if t, ok := openTxs.Load(k); ok {
+			return t.(*Tx)
+		}
+	}
+	return nil
+}
+
+// txOwner is the pool of s, or s while it is not in a pool
+func (s *Session) txOwner() interface{} {
+	if sp := s.getPool(); sp != nil {
+		return sp
+	}
+	return s
+}
+
+// WithTx runs fn in a transaction.
+// It commits while fn returns nil, and rolls back while fn returns an error or panics.
+// Called with the ctx of an open transaction inside its fn, it runs fn in a SAVEPOINT as Tx.WithTx,
+// so the ctx of an open transaction is not for the other goroutines.
+func (s *Session) WithTx(ctx droictx.Context, fn func(tx *Tx) error, opts ...TxOptions) de.AsDroiError {
+	if t := openTx(ctx, s.txOwner()); t != nil {
+		return t.WithTx(ctx, fn, opts...)
+	}
+	_, err := s.runTx(ctx, txOption(opts), fn)
+	return s.txError(err)
+}
+
+// WithTxRetry is WithTx, but re-runs the whole fn while the transaction
+// failed on serialization failure or deadlock, until policy.MaxAttempts.
+// The zero fields of policy are taken from DefaultTxRetryPolicy.
+// Inside an open transaction, it is a SAVEPOINT, and the outer transaction is the one to retry.
+func (s *Session) WithTxRetry(ctx droictx.Context, policy TxRetryPolicy, fn func(tx *Tx) error, opts ...TxOptions) de.AsDroiError {
+	if t := openTx(ctx, s.txOwner()); t != nil {
+		return t.WithTx(ctx, fn, opts...)
+	}
+	return s.txError(retryTx(ctx, s.Name, policy, func() (bool, error) {
+		return s.runTx(ctx, txOption(opts), fn)
+	}))
+}
+
+// retryTx calls run until it succeeds, fails without retryable, or policy.MaxAttempts.
+// The backoff stops while the context of ctx is done, the last error is returned.
+func retryTx(ctx droictx.Context, name string, policy TxRetryPolicy, run func() (bool, error)) error {
+	policy = policy.withDefaults()
+	for attempt := 1; ; attempt++ {
+		retryable, err := run()
+		if err == nil || !retryable || attempt >= policy.MaxAttempts {
+			return err
+		}
+		retryLog(ctx, name, attempt, err)
+		if !sleep(ctx, backoff(attempt, policy.InitialBackoff, policy.MaxBackoff, policy.Jitter)) {
+			return err
+		}
+	}
+}
+
+// sleep waits for d, it returns false while the context of ctx is done first
+func sleep(ctx droictx.Context, d time.Duration) bool {
+	std := stdContext(ctx)
+	if std == nil {
+		time.Sleep(d)
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-std.Done():
+		return false
+	}
+}
+
+// runTx returns the raw error of the transaction, and whether it is worth a retry
+func (s *Session) runTx(ctx droictx.Context, opt *TxOptions, fn func(tx *Tx) error) (retryable bool, err error) {
+	setTx := ""
+	if opt != nil {
+		if setTx, err = opt.setTransaction(); err != nil {
+			return false, err
+		}
+	}
+	// BeginTx on Conn itself keeps its settings, and binds the transaction to the context of ctx
+	std := stdContext(ctx)
+	if std == nil {
+		std = context.Background()
+	}
+	c := s.conn().BeginTx(std, nil)
+	if c.Error != nil {
+		return false, c.Error
+	}
+	// SET TRANSACTION must come before any query of the transaction
+	if len(setTx) > 0 {
+		if err = c.Exec(setTx).Error; err != nil {
+			c.Rollback()
+			return false, err
+		}
+	}
+	if d := statementTimeout(ctx); d > 0 {
+		if err = c.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", millis(d))).Error; err != nil {
+			c.Rollback()
+			return false, err
+		}
+	}
+	tx := &Tx{Conn: c, s: s}
+	if opt != nil {
+		tx.opts = *opt
+	}
+	if k, ok := newTxKey(ctx, s.txOwner()); ok {
+		openTxs.Store(k, tx)
+		defer openTxs.Delete(k)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			c.Rollback()
+			panic(r)
+		}
+	}()
+	if err = fn(tx); err != nil {
+		c.Rollback()
+		return tx.retryable || isRetryableTxError(err), err
+	}
+	err = c.Commit().Error
+	return isRetryableTxError(err), err
+}
+
+// txError keeps the DroiError returned by the closure, and maps the others
+func (s *Session) txError(err error) de.AsDroiError {
+	if err == nil {
+		return nil
+	}
+	if dErr, ok := err.(de.AsDroiError); ok {
+		return dErr
+	}
+	return s.CheckDatabaseError(err)
+}
+
+// WithTx runs fn inside a SAVEPOINT of t.
+// It releases the savepoint while fn returns nil, and rolls back to it while fn returns an error or panics.
+// A savepoint keeps the options of t, so opts other than them return ErrTxOptionsConflict.
+func (t *Tx) WithTx(ctx droictx.Context, fn func(tx *Tx) error, opts ...TxOptions) de.AsDroiError {
+	if o := txOption(opts); o != nil && *o != t.opts {
+		return de.NewTraceWithMsg(ErrTxOptionsConflict, "a savepoint keeps the options of its transaction")
+	}
+	t.savepoints++
+	name := "sp_" + strconv.Itoa(t.savepoints)
+	if err := t.Conn.Exec("SAVEPOINT " + name).Error; err != nil {
+		return t.CheckDatabaseError(err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.Conn.Exec("ROLLBACK TO SAVEPOINT " + name)
+			panic(r)
+		}
+	}()
+	if err := fn(t); err != nil {
+		if isRetryableTxError(err) {
+			t.retryable = true
+		}
+		t.Conn.Exec("ROLLBACK TO SAVEPOINT " + name)
+		return t.s.txError(err)
+	}
+	return t.CheckDatabaseError(t.Conn.Exec("RELEASE SAVEPOINT " + name).Error)
+}
+
+// CheckDatabaseError maps err as Session.CheckDatabaseError, and remembers the retryable ones
+func (t *Tx) CheckDatabaseError(err error) de.AsDroiError {
+	if isRetryableTxError(err) {
+		t.retryable = true
+	}
+	return t.s.CheckDatabaseError(err)
+}
+
+func (t *Tx) OneRecord(ctx droictx.Context, ret interface{}, whereClause string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(whereClause, args); err != nil {
+		return err
+	}
+	where := append([]interface{}{whereClause}, args...)
+	defer t.s.logSQL(ctx, whereClause, time.Now())
+	return t.CheckDatabaseError(t.Conn.First(ret, where...).Error)
+}
+
+func (t *Tx) Query(ctx droictx.Context, where, order string, limit, offset int, ret interface{}) de.AsDroiError {
+	return t.CriteriaQuery(ctx, ret, order, limit, offset, where)
+}
+
+func (t *Tx) CriteriaQuery(ctx droictx.Context, ret interface{}, order string, limit, offset int, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	q := t.Conn
+	if len(criteria) > 0 {
+		q = q.Where(criteria, args...)
+	}
+	if len(order) > 0 {
+		q = q.Order(order)
+	}
+	q = q.Offset(offset).Limit(limit)
+	defer t.s.logSQL(ctx, criteria, time.Now())
+	return t.CheckDatabaseError(q.Find(ret).Error)
+}
+
+func (t *Tx) TableQuery(ctx droictx.Context, table, where, order string, limit, offset int, ret interface{}) de.AsDroiError {
+	return t.CriteriaTableQuery(ctx, ret, table, order, limit, offset, where)
+}
+
+func (t *Tx) CriteriaTableQuery(ctx droictx.Context, ret interface{}, table, order string, limit, offset int, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	q := t.Conn.Table(table)
+	if len(criteria) > 0 {
+		q = q.Where(criteria, args...)
+	}
+	if len(order) > 0 {
+		q = q.Order(order)
+	}
+	q = q.Offset(offset).Limit(limit)
+	defer t.s.logSQL(ctx, criteria, time.Now())
+	return t.CheckDatabaseError(q.Find(ret).Error)
+}
+
+func (t *Tx) SQLQuery(ctx droictx.Context, ret interface{}, querySql string, args ...interface{}) de.AsDroiError {
+	defer t.s.logSQL(ctx, querySql, time.Now())
+	return t.CheckDatabaseError(t.Conn.Raw(querySql, args...).Scan(ret).Error)
+}
+
+func (t *Tx) WhereQuery(ctx droictx.Context, where interface{}, order string, limit, offset int, ret interface{}) de.AsDroiError {
+	tmp := t.Conn.Where(where)
+	if len(order) > 0 {
+		tmp = tmp.Order(order)
+	}
+	return t.CheckDatabaseError(tmp.Limit(limit).Offset(offset).Find(ret).Error)
+}
+
+func (t *Tx) Count(ctx droictx.Context, where string, model interface{}, ret *int) de.AsDroiError {
+	return t.CriteriaCount(ctx, model, ret, where)
+}
+
+func (t *Tx) CriteriaCount(ctx droictx.Context, model interface{}, ret *int, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	q := t.Conn
+	if len(criteria) > 0 {
+		q = q.Where(criteria, args...)
+	}
+	defer t.s.logSQL(ctx, criteria, time.Now())
+	return t.CheckDatabaseError(q.Model(model).Count(ret).Error)
+}
+
+func (t *Tx) Insert(ctx droictx.Context, ret interface{}) de.AsDroiError {
+	return t.CheckDatabaseError(t.Conn.Create(ret).Error)
+}
+
+func (t *Tx) OmitInsert(ctx droictx.Context, ret interface{}, omit string) de.AsDroiError {
+	return t.CheckDatabaseError(t.Conn.Omit(omit).Create(ret).Error)
+}
+
+func (t *Tx) Update(ctx droictx.Context, ret interface{}, fields map[string]interface{}) de.AsDroiError {
+	return t.CheckDatabaseError(t.Conn.Model(ret).UpdateColumns(fields).Error)
+}
+
+func (t *Tx) UpdateNonBlank(ctx droictx.Context, ret interface{}) de.AsDroiError {
+	return t.CheckDatabaseError(t.Conn.Model(ret).Update(ret).Error)
+}
+
+func (t *Tx) CriteriaUpdate(ctx droictx.Context, ret interface{}, fields map[string]interface{}, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	return t.CheckDatabaseError(t.Conn.Model(ret).Where(criteria, args...).UpdateColumns(fields).Error)
+}
+
+func (t *Tx) Delete(ctx droictx.Context, ret interface{}) de.AsDroiError {
+	return t.CheckDatabaseError(t.Conn.Delete(ret).Error)
+}
+
+func (t *Tx) CriteriaDelete(ctx droictx.Context, ret interface{}, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	return t.CheckDatabaseError(t.Conn.Where(criteria, args...).Delete(ret).Error)
+}
+
+func (t *Tx) Join(ctx droictx.Context, ret interface{}, table, fields, join, order, criteria string, args ...interface{}) de.AsDroiError {
+	if err := checkWhere(criteria, args); err != nil {
+		return err
+	}
+	pgErr := t.Conn.
+		Table(table).
+		Select(fields).
+		Joins(join).
+		Where(criteria, args...).
+		Order(order).
+		Find(ret).Error
+	return t.CheckDatabaseError(pgErr)
+}
+
+func (t *Tx) Execute(ctx droictx.Context, sql string, values ...interface{}) de.AsDroiError {
+	return t.CheckDatabaseError(t.Conn.Exec(sql, values...).Error)
+}
+
+func (t *Tx) RowScan(ctx droictx.Context, sql string, ptrs ...interface{}) de.AsDroiError {
+	return t.RowScanArgs(ctx, sql, nil, ptrs...)
+}
+
+func (t *Tx) RowScanArgs(ctx droictx.Context, sql string, args []interface{}, ptrs ...interface{}) de.AsDroiError {
+	defer t.s.logSQL(ctx, sql, time.Now())
+	return t.CheckDatabaseError(t.Conn.Raw(sql, args...).Row().Scan(ptrs...))
+}
+
+func (t *Tx) Rows(ctx droictx.Context, sql string, args ...interface{}) (rows *sql.Rows, err de.AsDroiError) {
+	rows, rawErr := t.Conn.Raw(sql, args...).Rows()
+	return rows, t.CheckDatabaseError(rawErr)
+}
+
+func (t *Tx) EachRow(ctx droictx.Context, querySql string, fn func(*sql.Rows) error, args ...interface{}) de.AsDroiError {
+	defer t.s.logSQL(ctx, querySql, time.Now())
+	rows, err := t.Conn.Raw(querySql, args...).Rows()
+	if err != nil {
+		return t.CheckDatabaseError(err)
+	}
+	return rowsError(t.CheckDatabaseError, eachRow(rows, fn))
+}
@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	de "github.com/DroiTaipei/droipkg"
+)
+
+// TestTxWithTxOptionsConflict checks a savepoint cannot change the options of its transaction
+func TestTxWithTxOptionsConflict(t *testing.T) {
+	tx := &Tx{opts: TxOptions{Isolation: sql.LevelSerializable}}
+	ran := false
+	fn := func(*Tx) error {
+		ran = true
+		return nil
+	}
+
+	err := tx.WithTx(nil, fn, TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+	if err == nil || err.AsDroiError().ErrorCode() != ErrTxOptionsConflict.ErrorCode() {
+		t.Errorf("read only in a read write transaction: got %v, want ErrTxOptionsConflict", err)
+	}
+	err = tx.WithTx(nil, fn, TxOptions{Isolation: sql.LevelReadCommitted})
+	if err == nil || err.AsDroiError().ErrorCode() != ErrTxOptionsConflict.ErrorCode() {
+		t.Errorf("read committed in a serializable transaction: got %v, want ErrTxOptionsConflict", err)
+	}
+	if ran {
+		t.Error("fn runs with conflicting options")
+	}
+	if tx.savepoints != 0 {
+		t.Errorf("savepoints = %d, want 0", tx.savepoints)
+	}
+}
+
+func TestSetTransaction(t *testing.T) {
+	want := map[TxOptions]string{
+		{}:                                   "",
+		{ReadOnly: true}:                     "SET TRANSACTION READ ONLY",
+		{Isolation: sql.LevelRepeatableRead}: "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		{Isolation: sql.LevelSerializable, ReadOnly: true, Deferrable: true}: "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY, DEFERRABLE",
+	}
+	for o, stmt := range want {
+		got, err := o.setTransaction()
+		if err != nil || got != stmt {
+			t.Errorf("%+v: got %q, %v, want %q", o, got, err, stmt)
+		}
+	}
+	o := TxOptions{Isolation: sql.LevelLinearizable}
+	if _, err := o.setTransaction(); err == nil {
+		t.Error("setTransaction takes an isolation level PostgreSQL lacks")
+	}
+}
+
+// TestNestedTopLevelWithTx checks the pool hands a nested call to the open transaction of ctx,
+// the pool has no session, so a new transaction would fail with ErrDatabaseUnavailable
+func TestNestedTopLevelWithTx(t *testing.T) {
+	sp := &SessionPool{mode: ROUND_ROBIN_MODE}
+	ctx := newTestCtx()
+	k, ok := newTxKey(ctx, sp)
+	if !ok {
+		t.Fatal("no key for a pointer context")
+	}
+	openTxs.Store(k, &Tx{})
+	defer openTxs.Delete(k)
+
+	conflict := TxOptions{ReadOnly: true}
+	nested := func(err interface{ AsDroiError() de.DroiError }) bool {
+		return err != nil && err.AsDroiError().ErrorCode() == ErrTxOptionsConflict.ErrorCode()
+	}
+	if err := sp.WithTx(ctx, nil, conflict); !nested(err) {
+		t.Errorf("WithTx: got %v, want the savepoint of the open transaction", err)
+	}
+	if err := sp.WithTxRetry(WithStatementTimeout(ctx, time.Second), TxRetryPolicy{}, nil, conflict); !nested(err) {
+		t.Errorf("WithTxRetry under a stdCtx: got %v, want the savepoint of the open transaction", err)
+	}
+	if err := sp.WithTx(newTestCtx(), nil, conflict); nested(err) {
+		t.Error("WithTx of another ctx joins the open transaction")
+	}
+	if err := (&SessionPool{mode: ROUND_ROBIN_MODE}).WithTx(ctx, nil, conflict); nested(err) {
+		t.Error("WithTx of another pool joins the open transaction")
+	}
+}
@@ -0,0 +1,31 @@
+package postgres
+
+import (
+	"strings"
+	"sync/atomic"
+
+	de "github.com/DroiTaipei/droipkg"
+)
+
+// strictWhere is set by SetStrictWhere
+var strictWhere int32
+
+// SetStrictWhere rejects the where clauses which contain quotes without args by ErrUnsafeWhere,
+// such a clause likely has its values put in by fmt.Sprintf instead of bind parameters
+func SetStrictWhere(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&strictWhere, v)
+}
+
+func checkWhere(where string, args []interface{}) de.AsDroiError {
+	if len(args) > 0 || atomic.LoadInt32(&strictWhere) == 0 {
+		return nil
+	}
+	if strings.ContainsAny(where, `'"`) {
+		return de.NewTraceWithMsg(ErrUnsafeWhere, where)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package postgres
+
+import (
+	"testing"
+)
+
+// unsafeWhere is whether checkWhere rejects where, failing t on an error other than ErrUnsafeWhere
+func unsafeWhere(t *testing.T, where string, args ...interface{}) bool {
+	err := checkWhere(where, args)
+	if err != nil && err.AsDroiError().ErrorCode() != ErrUnsafeWhere.ErrorCode() {
+		t.Errorf("%q: got %v, want ErrUnsafeWhere", where, err)
+	}
+	return err != nil
+}
+
+func TestCheckWhereLoose(t *testing.T) {
+	if unsafeWhere(t, "name = 'bob'") {
+		t.Error("the loose mode rejects a quoted literal")
+	}
+}
+
+func TestCheckWhereStrict(t *testing.T) {
+	SetStrictWhere(true)
+	defer SetStrictWhere(false)
+
+	// Literals written in the criteria are the injection the strict mode guards against
+	for _, where := range []string{"name = 'bob'", `"name" = 1`} {
+		if !unsafeWhere(t, where) {
+			t.Errorf("%q without args is accepted", where)
+		}
+	}
+	// With bind parameters the caller is taken to bind the values
+	if unsafeWhere(t, "name = ?", "bob") || unsafeWhere(t, "name = 'bob' AND id = ?", 1) {
+		t.Error("criteria with args are rejected")
+	}
+	if unsafeWhere(t, "id > 0") || unsafeWhere(t, "") {
+		t.Error("criteria without literals are rejected")
+	}
+}